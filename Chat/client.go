@@ -0,0 +1,296 @@
+package Chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/jasonfantl/P2PChat/P2Proto"
+)
+
+// chat rooms on top of P2Proto, for programs that want to chat without the terminal UI:
+//
+//	client := Chat.NewClient("p2pchat_data", logFunc)
+//	client.JoinRoom("friends", key)
+//	go client.Start(nil)
+//	for event := range client.Events() {
+//		...
+//	}
+//
+// P2Proto is set up once per process, so a program only ever has one Client. set P2Proto's options (ListenAddress,
+// BlobDir...) before calling Start. rooms can be joined before or after Start, ones joined before are announced to
+// peers as they connect
+
+type Client struct {
+	dataDir string // history and downloads are kept here
+	log     func(string)
+	events  chan Event
+
+	lock        sync.Mutex
+	rooms       map[string]*chatroom
+	downloading map[string]bool // by pendingDownloadPath, so an offer is only downloaded once at a time
+}
+
+type chatroom struct {
+	name    string
+	key     []byte
+	history []string
+	files   []FileManifest
+
+	saveLock sync.Mutex // held while a line is added, so the file keeps the order of history
+}
+
+type EventType int
+
+const (
+	MessageEvent   EventType = iota // Line was added to Room's history, said by From, or by us if From is empty
+	RoomJoined                      // Room was joined
+	RoomLeft                        // Room was left
+	FileDownloaded                  // a file shared in Room was saved to Text
+)
+
+type Event struct {
+	Type EventType
+	Room string
+	From string // where a message came from
+	Text string // what was said, without who said it
+	Line string // how it appears in the room's history
+}
+
+// an AES-GCM sealed chat line, payload 64
+type Message []byte
+
+// events Events hasnt had read yet, once full new ones are dropped rather than holding up the network
+var eventBuffer = 256
+
+// dataDir is where history and downloads are kept, log gets everything worth telling the user
+func NewClient(dataDir string, log func(string)) *Client {
+	P2Proto.RegisterPayload(64, Message{})
+	P2Proto.RegisterPayload(65, FileOffer{})
+
+	return &Client{
+		dataDir:     dataDir,
+		log:         log,
+		events:      make(chan Event, eventBuffer),
+		rooms:       make(map[string]*chatroom),
+		downloading: make(map[string]bool),
+	}
+}
+
+// joins the network, blocking like P2Proto.Setup. peers is called whenever our peers change, and may be nil
+func (client *Client) Start(peers func(P2Proto.PeerList)) {
+	if peers == nil {
+		peers = func(P2Proto.PeerList) {}
+	}
+	go client.resumeDownloads()
+	P2Proto.Setup(client.recievePacket, peers, client.log)
+}
+
+// what happens in our rooms, read it or events are dropped once eventBuffer fills
+func (client *Client) Events() <-chan Event {
+	return client.events
+}
+
+func (client *Client) emit(event Event) {
+	select {
+	case client.events <- event:
+	default:
+		client.log("dropped a chat event, nobody is reading them")
+	}
+}
+
+// joins a room, loading what was said in it last time. key is the room's AES key, 16, 24 or 32 bytes
+func (client *Client) JoinRoom(name string, key []byte) error {
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return errors.New("a room key must be 16, 24 or 32 bytes, not " + strconv.Itoa(len(key)))
+	}
+
+	if _, err := client.room(name); err == nil {
+		return nil
+	}
+	chatroom := &chatroom{
+		name:    name,
+		key:     key,
+		history: make([]string, 0),
+	}
+	client.loadHistory(chatroom) // before taking the lock, it reads from disk
+
+	client.lock.Lock()
+	if _, exist := client.rooms[name]; exist { // joined while we were loading
+		client.lock.Unlock()
+		return nil
+	}
+	client.rooms[name] = chatroom
+	client.lock.Unlock()
+	for _, manifest := range chatroom.files {
+		pinFile(manifest)
+	}
+
+	// lets other members find us through the DHT, and get the room's messages
+	go P2Proto.Provide(roomTopic(chatroom))
+	P2Proto.Subscribe(roomTopic(chatroom))
+
+	client.emit(Event{Type: RoomJoined, Room: name})
+	return nil
+}
+
+// stops getting the room's messages, its history stays on disk for if we join again
+func (client *Client) LeaveRoom(name string) error {
+	client.lock.Lock()
+	chatroom, ok := client.rooms[name]
+	delete(client.rooms, name)
+	client.lock.Unlock()
+	if !ok {
+		return errors.New("not in room " + name)
+	}
+
+	P2Proto.Unsubscribe(roomTopic(chatroom))
+	P2Proto.StopProviding(roomTopic(chatroom))
+	for _, manifest := range chatroom.files {
+		for _, hash := range manifest.Chunks {
+			P2Proto.UnpinBlob(hash)
+		}
+	}
+
+	client.emit(Event{Type: RoomLeft, Room: name})
+	return nil
+}
+
+// the names of the rooms we are in, sorted
+func (client *Client) Rooms() []string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	names := make([]string, 0, len(client.rooms))
+	for name := range client.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// what was said in a room, oldest first
+func (client *Client) History(name string) ([]string, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	chatroom, ok := client.rooms[name]
+	if !ok {
+		return nil, errors.New("not in room " + name)
+	}
+	return append([]string{}, chatroom.history...), nil
+}
+
+// the files shared in a room
+func (client *Client) Files(name string) ([]FileManifest, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	chatroom, ok := client.rooms[name]
+	if !ok {
+		return nil, errors.New("not in room " + name)
+	}
+	return append([]FileManifest{}, chatroom.files...), nil
+}
+
+func (client *Client) room(name string) (*chatroom, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	chatroom, ok := client.rooms[name]
+	if !ok {
+		return nil, errors.New("not in room " + name)
+	}
+	return chatroom, nil
+}
+
+// sends text to everyone in the room
+func (client *Client) Send(name string, text string) error {
+	chatroom, err := client.room(name)
+	if err != nil {
+		return err
+	}
+
+	client.addToHistory(chatroom, Event{Type: MessageEvent, Room: name, Text: text, Line: text})
+
+	encrypted := Message(encrypt([]byte(text), chatroom.key))
+
+	P2Proto.Publish(roomTopic(chatroom), encrypted)
+	return nil
+}
+
+// sends to a single node, encrypted with the room's key so only a member can read it
+func (client *Client) SendDirect(name string, gid string, text string) error {
+	chatroom, err := client.room(name)
+	if err != nil {
+		return err
+	}
+
+	if !P2Proto.SendDirect(gid, Message(encrypt([]byte(text), chatroom.key))) {
+		return errors.New("could not send to " + gid)
+	}
+	client.addToHistory(chatroom, Event{Type: MessageEvent, Room: name, Text: text, Line: "to " + gid + ": " + text})
+	return nil
+}
+
+// other members of the room, found through the DHT
+func (client *Client) FindMembers(name string) ([]P2Proto.Contact, error) {
+	chatroom, err := client.room(name)
+	if err != nil {
+		return nil, err
+	}
+	return P2Proto.FindProviders(roomTopic(chatroom)), nil
+}
+
+// an opaque ID for a room, members can find each other by it without revealing the name or key
+func roomTopic(chatroom *chatroom) string {
+	sum := sha256.Sum256(append([]byte("topic:"), chatroom.key...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (client *Client) recievePacket(packet P2Proto.Packet) {
+	if packet.Type == P2Proto.PUBLISH || packet.Type == P2Proto.MESSAGE || packet.Type == P2Proto.DIRECT {
+		if offer, ok := packet.Payload.(FileOffer); ok {
+			client.recieveFileOffer(packet, offer)
+			return
+		}
+
+		message, ok := packet.Payload.(Message)
+		if !ok {
+			client.log("invalid message from " + packet.Origin)
+			return
+		}
+
+		for _, chatroom := range client.roomsFor(packet) {
+			decrypted, ok := decrypt(message, chatroom.key)
+			if !ok {
+				continue
+			}
+
+			plaintext := string(decrypted)
+
+			line := packet.Origin + ": " + plaintext
+			if packet.Type == P2Proto.DIRECT {
+				line = packet.Origin + " (direct): " + plaintext
+			}
+			client.addToHistory(chatroom, Event{Type: MessageEvent, Room: chatroom.name, From: packet.Origin, Text: plaintext, Line: line})
+		}
+	}
+}
+
+// published packets say which room they are for, the others we just try every room's key on
+func (client *Client) roomsFor(packet P2Proto.Packet) []*chatroom {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	rooms := make([]*chatroom, 0)
+	for _, chatroom := range client.rooms {
+		if packet.Type != P2Proto.PUBLISH || packet.Topic == roomTopic(chatroom) {
+			rooms = append(rooms, chatroom)
+		}
+	}
+	return rooms
+}
@@ -0,0 +1,137 @@
+package Chat
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testClient(dataDir string) *Client {
+	return NewClient(dataDir, func(string) {})
+}
+
+func TestJoinRoomKeyLength(t *testing.T) {
+	client := testClient(t.TempDir())
+
+	for _, length := range []int{0, 8, 15, 17, 31, 33, 64} {
+		if err := client.JoinRoom("room", make([]byte, length)); err == nil {
+			t.Errorf("joined with a %d byte key", length)
+		}
+	}
+	if rooms := client.Rooms(); len(rooms) != 0 {
+		t.Fatalf("bad keys left us in %v", rooms)
+	}
+
+	for _, length := range []int{16, 24, 32} {
+		if err := client.JoinRoom("room", bytes.Repeat([]byte{1}, length)); err != nil {
+			t.Errorf("%d byte key: %v", length, err)
+		}
+	}
+	if rooms := client.Rooms(); len(rooms) != 1 {
+		t.Fatalf("joining again changed our rooms to %v", rooms)
+	}
+}
+
+func TestUnknownRoom(t *testing.T) {
+	client := testClient(t.TempDir())
+
+	if err := client.LeaveRoom("nowhere"); err == nil {
+		t.Errorf("left a room we are not in")
+	}
+	if _, err := client.History("nowhere"); err == nil {
+		t.Errorf("got history of a room we are not in")
+	}
+	if err := client.Send("nowhere", "hello"); err == nil {
+		t.Errorf("sent to a room we are not in")
+	}
+}
+
+func TestJoinLeave(t *testing.T) {
+	client := testClient(t.TempDir())
+
+	if err := client.JoinRoom("room", make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-client.Events(); event.Type != RoomJoined || event.Room != "room" {
+		t.Errorf("joining sent %+v", event)
+	}
+	if err := client.LeaveRoom("room"); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-client.Events(); event.Type != RoomLeft || event.Room != "room" {
+		t.Errorf("leaving sent %+v", event)
+	}
+	if err := client.Send("room", "hello"); err == nil {
+		t.Errorf("sent to a room we left")
+	}
+}
+
+func TestHistoryKeptOnDisk(t *testing.T) {
+	dataDir := t.TempDir()
+	client := testClient(dataDir)
+	client.JoinRoom("room", make([]byte, 16))
+	for _, text := range []string{"one", "two"} {
+		if err := client.Send("room", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.LeaveRoom("room")
+
+	// as if the program was started again
+	client = testClient(dataDir)
+	if err := client.JoinRoom("room", make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	history, err := client.History("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0] != "one" || history[1] != "two" {
+		t.Fatalf("history after joining again is %v", history)
+	}
+}
+
+func TestHistoryCutOffLine(t *testing.T) {
+	dataDir := t.TempDir()
+	client := testClient(dataDir)
+	client.JoinRoom("room", make([]byte, 16))
+	client.Send("room", "kept")
+	client.LeaveRoom("room")
+
+	// as if we crashed halfway through writing the next line
+	file, err := os.OpenFile(client.historyPath("room"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Line":"lo`)
+	file.Close()
+
+	client = testClient(dataDir)
+	client.JoinRoom("room", make([]byte, 16))
+	history, _ := client.History("room")
+	if len(history) != 1 || history[0] != "kept" {
+		t.Fatalf("history after a cut off line is %v", history)
+	}
+}
+
+func TestOldHistoryRead(t *testing.T) {
+	dataDir := t.TempDir()
+	client := testClient(dataDir)
+	os.MkdirAll(filepath.Dir(client.oldHistoryPath("room")), 0700)
+	err := os.WriteFile(client.oldHistoryPath("room"), []byte(`{"History":["old"],"Files":null}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.JoinRoom("room", make([]byte, 16))
+	client.Send("room", "new")
+	client.LeaveRoom("room")
+
+	client = testClient(dataDir)
+	client.JoinRoom("room", make([]byte, 16))
+	history, _ := client.History("room")
+	if len(history) != 2 || history[0] != "old" || history[1] != "new" {
+		t.Fatalf("history with an old file is %v", history)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package Chat
 
 import (
 	"crypto/aes"
@@ -51,6 +51,11 @@ func decrypt(encryptedMessage, key []byte) ([]byte, bool) {
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
 
+	//Make sure there is a nonce and a tag to read, anything shorter was not made by encrypt
+	if len(encryptedMessage) < nonceSize+aesGCM.Overhead() {
+		return nil, false
+	}
+
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := encryptedMessage[:nonceSize], encryptedMessage[nonceSize:]
 
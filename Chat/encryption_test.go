@@ -0,0 +1,23 @@
+package Chat
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func FuzzDecrypt(f *testing.F) {
+	f.Add(encrypt([]byte("hello"), testKey))
+	f.Add([]byte{})
+	f.Add([]byte("short"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decrypt(data, testKey) // must not panic on anything a peer sends
+
+		decrypted, ok := decrypt(encrypt(data, testKey), testKey)
+		if !ok || !bytes.Equal(decrypted, data) {
+			t.Fatalf("could not decrypt what we encrypted")
+		}
+	})
+}
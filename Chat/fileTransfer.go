@@ -0,0 +1,352 @@
+package Chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jasonfantl/P2PChat/P2Proto"
+)
+
+const chunkSize = 32 * 1024
+const maxChunksInFlight = 8
+const chunkRetryInterval = 3 * time.Second
+
+// biggest file we will download, a manifest decides how much we ask the network for
+const maxFileSize = 1 << 30
+
+// a download gives up once a chunk has been asked for this many times, or it has run this long. it is tried again
+// the next time we start
+const maxChunkRequests = 20
+const downloadTimeout = time.Hour
+
+// an encrypted FileManifest, sent to the room like a Message, payload 65
+type FileOffer []byte
+
+// describes a file split into encrypted chunks, each chunk is a blob addressed by the hash of its ciphertext
+type FileManifest struct {
+	Name   string
+	Size   int64
+	Chunks []string
+}
+
+// what we save to disk so an interrupted download can pick up where it left off
+type pendingDownload struct {
+	Room     string
+	Manifest FileManifest
+}
+
+func (client *Client) downloadsDir() string {
+	return filepath.Join(client.dataDir, "downloads")
+}
+
+func (client *Client) pendingDir() string {
+	return filepath.Join(client.downloadsDir(), "pending")
+}
+
+// shares a file with the room, its chunks are fetched from us as members want them
+func (client *Client) SendFile(name string, path string) error {
+	chatroom, err := client.room(name)
+	if err != nil {
+		return err
+	}
+
+	// others would refuse it, dont read it all in to find out
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New(path + " is not a file")
+	}
+	if info.Size() > maxFileSize {
+		return errors.New(path + " is over the limit of " + strconv.Itoa(maxFileSize) + " bytes")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	manifest := FileManifest{
+		Name: filepath.Base(path),
+	}
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(file, chunk)
+		if err == io.EOF && len(manifest.Chunks) > 0 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		hash, storeErr := P2Proto.StoreBlob(encrypt(chunk[:n], chatroom.key))
+		if storeErr != nil {
+			return storeErr
+		}
+		manifest.Chunks = append(manifest.Chunks, hash)
+		manifest.Size += int64(n)
+		if n < chunkSize {
+			break
+		}
+	}
+	if err := manifest.validate(); err != nil { // it changed while we read it
+		return err
+	}
+
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	text := "sent file " + manifest.Name + " (" + strconv.FormatInt(manifest.Size, 10) + " bytes)"
+	client.addFileToHistory(chatroom, Event{Type: MessageEvent, Room: name, Text: text, Line: text}, manifest)
+
+	P2Proto.Publish(roomTopic(chatroom), FileOffer(encrypt(encoded, chatroom.key)))
+	P2Proto.AnnounceBlobs(manifest.Chunks)
+	return nil
+}
+
+func (client *Client) recieveFileOffer(packet P2Proto.Packet, offer FileOffer) {
+	origin := packet.Origin
+	for _, chatroom := range client.roomsFor(packet) {
+		decrypted, ok := decrypt(offer, chatroom.key)
+		if !ok {
+			continue
+		}
+
+		manifest := FileManifest{}
+		err := json.Unmarshal(decrypted, &manifest)
+		if err == nil {
+			err = manifest.validate()
+		}
+		if err != nil {
+			client.log("invalid file offer from " + origin + ": " + err.Error())
+			return
+		}
+
+		text := "shared file " + manifest.Name + " (" + strconv.FormatInt(manifest.Size, 10) + " bytes)"
+		event := Event{Type: MessageEvent, Room: chatroom.name, From: origin, Text: text, Line: origin + ": " + text}
+		client.addFileToHistory(chatroom, event, manifest)
+
+		download := pendingDownload{
+			Room:     chatroom.name,
+			Manifest: manifest,
+		}
+		err = client.savePendingDownload(download)
+		if err != nil {
+			client.log(err.Error())
+		}
+		go client.runDownload(download)
+		return
+	}
+}
+
+// the sender decides the chunk list, so make sure it is the one SendFile would have made for a file that size
+func (manifest FileManifest) validate() error {
+	if manifest.Size < 0 || manifest.Size > maxFileSize {
+		return errors.New("file size " + strconv.FormatInt(manifest.Size, 10) + " is over the limit of " + strconv.Itoa(maxFileSize))
+	}
+	chunks := (manifest.Size + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1 // SendFile still sends an empty chunk for an empty file
+	}
+	if int64(len(manifest.Chunks)) != chunks {
+		return errors.New(strconv.Itoa(len(manifest.Chunks)) + " chunks for " + strconv.FormatInt(manifest.Size, 10) + " bytes, expected " + strconv.FormatInt(chunks, 10))
+	}
+	for _, hash := range manifest.Chunks {
+		if !P2Proto.ValidBlobHash(hash) {
+			return errors.New("invalid chunk hash " + strconv.Quote(hash))
+		}
+	}
+	return nil
+}
+
+func (client *Client) pendingDownloadPath(download pendingDownload) string {
+	encoded, _ := json.Marshal(download)
+	sum := sha256.Sum256(encoded)
+	return filepath.Join(client.pendingDir(), hex.EncodeToString(sum[:])+".json")
+}
+
+func (client *Client) savePendingDownload(download pendingDownload) error {
+	err := os.MkdirAll(client.pendingDir(), 0700)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(download)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(client.pendingDownloadPath(download), encoded, 0600)
+}
+
+// restarts any downloads that were interrupted last time we ran
+func (client *Client) resumeDownloads() {
+	files, err := os.ReadDir(client.pendingDir())
+	if err != nil {
+		return // nothing pending
+	}
+
+	for _, file := range files {
+		encoded, err := os.ReadFile(filepath.Join(client.pendingDir(), file.Name()))
+		if err != nil {
+			client.log(err.Error())
+			continue
+		}
+		download := pendingDownload{}
+		err = json.Unmarshal(encoded, &download)
+		if err == nil {
+			err = download.Manifest.validate()
+		}
+		if err != nil {
+			client.log("invalid pending download " + file.Name() + ": " + err.Error())
+			os.Remove(filepath.Join(client.pendingDir(), file.Name()))
+			continue
+		}
+
+		client.log("resuming download of " + download.Manifest.Name)
+		go client.runDownload(download)
+	}
+}
+
+// keeps asking the network for missing chunks until we have them all, then assembles the file
+func (client *Client) runDownload(download pendingDownload) {
+	key := client.pendingDownloadPath(download)
+	client.lock.Lock()
+	if client.downloading[key] {
+		client.lock.Unlock()
+		return // offered again while we are still on it
+	}
+	client.downloading[key] = true
+	client.lock.Unlock()
+	defer func() {
+		client.lock.Lock()
+		delete(client.downloading, key)
+		client.lock.Unlock()
+	}()
+
+	manifest := download.Manifest
+	lastRequest := make(map[string]time.Time)
+	requests := make(map[string]int)
+	deadline := time.Now().Add(downloadTimeout)
+
+	for {
+		missing := make([]string, 0)
+		for _, hash := range manifest.Chunks {
+			if !P2Proto.HasBlob(hash) {
+				missing = append(missing, hash)
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			client.log("gave up downloading " + manifest.Name + " after " + downloadTimeout.String() + ", " + strconv.Itoa(len(missing)) + " chunks still missing")
+			return
+		}
+
+		inFlight := 0
+		for _, hash := range missing {
+			if time.Since(lastRequest[hash]) < chunkRetryInterval {
+				inFlight++
+			}
+		}
+		for _, hash := range missing {
+			if inFlight >= maxChunksInFlight {
+				break
+			}
+			if time.Since(lastRequest[hash]) >= chunkRetryInterval {
+				if requests[hash] >= maxChunkRequests {
+					client.log("gave up downloading " + manifest.Name + ", nobody sent chunk " + hash)
+					return
+				}
+				P2Proto.WantBlob(hash)
+				lastRequest[hash] = time.Now()
+				requests[hash]++
+				inFlight++
+			}
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	path, err := client.assembleFile(download)
+	if err != nil {
+		client.log("failed to assemble " + manifest.Name + ": " + err.Error())
+		return
+	}
+	os.Remove(client.pendingDownloadPath(download))
+	client.log("finished downloading " + manifest.Name + " to " + path)
+	client.emit(Event{Type: FileDownloaded, Room: download.Room, Text: path})
+}
+
+// writes the file under a temporary name, only giving it its own once it is complete
+func (client *Client) assembleFile(download pendingDownload) (path string, err error) {
+	chatroom, err := client.room(download.Room)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(client.downloadsDir(), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// never trust the sender with our paths
+	name := filepath.Base(download.Manifest.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = "download"
+	}
+
+	file, err := os.CreateTemp(client.downloadsDir(), ".partial-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	for _, hash := range download.Manifest.Chunks {
+		encrypted, ok := P2Proto.GetBlob(hash)
+		if !ok {
+			return "", errors.New("missing chunk " + hash)
+		}
+		decrypted, ok := decrypt(encrypted, chatroom.key)
+		if !ok {
+			return "", errors.New("could not decrypt chunk " + hash)
+		}
+		_, err = file.Write(decrypted)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	path = filepath.Join(client.downloadsDir(), name)
+	for i := 1; fileExists(path); i++ {
+		path = filepath.Join(client.downloadsDir(), strconv.Itoa(i)+"_"+name)
+	}
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
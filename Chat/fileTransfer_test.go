@@ -0,0 +1,89 @@
+package Chat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestValidate(t *testing.T) {
+	chunks := func(n int) []string {
+		hashes := make([]string, n)
+		for i := range hashes {
+			hashes[i] = strings.Repeat("ab", 32)
+		}
+		return hashes
+	}
+	tests := []struct {
+		manifest FileManifest
+		ok       bool
+	}{
+		{manifest: FileManifest{Size: 0, Chunks: chunks(1)}, ok: true},
+		{manifest: FileManifest{Size: 1, Chunks: chunks(1)}, ok: true},
+		{manifest: FileManifest{Size: chunkSize, Chunks: chunks(1)}, ok: true},
+		{manifest: FileManifest{Size: chunkSize + 1, Chunks: chunks(2)}, ok: true},
+		{manifest: FileManifest{Size: maxFileSize, Chunks: chunks(maxFileSize / chunkSize)}, ok: true},
+		{manifest: FileManifest{Size: 0, Chunks: chunks(0)}},
+		{manifest: FileManifest{Size: 1, Chunks: chunks(2)}},
+		{manifest: FileManifest{Size: chunkSize + 1, Chunks: chunks(1)}},
+		{manifest: FileManifest{Size: 10, Chunks: chunks(100000)}},
+		{manifest: FileManifest{Size: -1, Chunks: chunks(1)}},
+		{manifest: FileManifest{Size: maxFileSize + 1, Chunks: chunks(maxFileSize/chunkSize + 1)}},
+		{manifest: FileManifest{Size: 1, Chunks: []string{""}}},
+		{manifest: FileManifest{Size: 1, Chunks: []string{"../../etc/passwd"}}},
+		{manifest: FileManifest{Size: 1, Chunks: []string{strings.Repeat("AB", 32)}}},
+	}
+
+	for _, test := range tests {
+		err := test.manifest.validate()
+		if test.ok && err != nil {
+			t.Errorf("size %d with %d chunks: %v", test.manifest.Size, len(test.manifest.Chunks), err)
+		} else if !test.ok && err == nil {
+			t.Errorf("size %d with %d chunks was accepted", test.manifest.Size, len(test.manifest.Chunks))
+		}
+	}
+}
+
+func TestSendFileTooBig(t *testing.T) {
+	client := testClient(t.TempDir())
+	client.JoinRoom("room", make([]byte, 16))
+
+	// sparse, so it takes no space
+	path := filepath.Join(t.TempDir(), "big")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err := os.Truncate(path, maxFileSize+1); err != nil {
+		t.Skip("cant make a big enough file:", err)
+	}
+
+	if err := client.SendFile("room", path); err == nil {
+		t.Fatalf("sent a file over the limit")
+	}
+}
+
+func TestAssembleMissingChunk(t *testing.T) {
+	client := testClient(t.TempDir())
+	client.JoinRoom("room", make([]byte, 16))
+
+	download := pendingDownload{
+		Room:     "room",
+		Manifest: FileManifest{Name: "file", Size: 1, Chunks: []string{strings.Repeat("00", 32)}},
+	}
+	if _, err := client.assembleFile(download); err == nil {
+		t.Fatalf("assembled a file without its chunk")
+	}
+
+	files, err := os.ReadDir(client.downloadsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			t.Errorf("%s left behind", file.Name())
+		}
+	}
+}
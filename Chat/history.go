@@ -0,0 +1,144 @@
+package Chat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jasonfantl/P2PChat/P2Proto"
+)
+
+// each room's history is kept as one JSON object per line, so adding to it only appends a line.
+// a crash can at worst cut off the last one, which is skipped when loading
+
+// a line of a room's history on disk
+type savedLine struct {
+	Line string
+	File *FileManifest `json:",omitempty"` // the file the line shared, if any
+}
+
+// what older versions kept for each room, all rewritten on every message. still read, never written
+type savedHistory struct {
+	History []string
+	Files   []FileManifest
+}
+
+func (client *Client) historyPath(name string) string {
+	// hex so any room name makes a safe file name
+	return filepath.Join(client.dataDir, "history", hex.EncodeToString([]byte(name))+".jsonl")
+}
+
+func (client *Client) oldHistoryPath(name string) string {
+	return filepath.Join(client.dataDir, "history", hex.EncodeToString([]byte(name))+".json")
+}
+
+func (client *Client) addToHistory(chatroom *chatroom, event Event) {
+	client.saveLine(chatroom, savedLine{Line: event.Line})
+	client.emit(event)
+}
+
+// files referenced in a room's history are pinned so the blob cache never evicts them
+func (client *Client) addFileToHistory(chatroom *chatroom, event Event, manifest FileManifest) {
+	pinFile(manifest)
+	client.saveLine(chatroom, savedLine{Line: event.Line, File: &manifest})
+	client.emit(event)
+}
+
+func pinFile(manifest FileManifest) {
+	for _, hash := range manifest.Chunks {
+		P2Proto.PinBlob(hash)
+	}
+}
+
+// adds the line to the room, then appends it to the room's file without holding client.lock
+func (client *Client) saveLine(chatroom *chatroom, line savedLine) {
+	chatroom.saveLock.Lock()
+	defer chatroom.saveLock.Unlock()
+
+	client.lock.Lock()
+	chatroom.history = append(chatroom.history, line.Line)
+	if line.File != nil {
+		chatroom.files = append(chatroom.files, *line.File)
+	}
+	client.lock.Unlock()
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		client.log(err.Error())
+		return
+	}
+
+	path := client.historyPath(chatroom.name)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		client.log(err.Error())
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		client.log(err.Error())
+		return
+	}
+	defer file.Close()
+
+	// one write, so a line is never split by another
+	_, err = file.Write(append(encoded, '\n'))
+	if err != nil {
+		client.log(err.Error())
+	}
+}
+
+// called before chatroom is added to client.rooms, so without the lock
+func (client *Client) loadHistory(chatroom *chatroom) {
+	client.loadOldHistory(chatroom)
+
+	file, err := os.Open(client.historyPath(chatroom.name))
+	if err != nil {
+		return // new room
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		encoded, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(encoded)) > 0 {
+			line := savedLine{}
+			if jsonErr := json.Unmarshal(encoded, &line); jsonErr != nil {
+				client.log("skipping invalid history line for " + chatroom.name + ": " + jsonErr.Error())
+			} else {
+				chatroom.history = append(chatroom.history, line.Line)
+				if line.File != nil {
+					chatroom.files = append(chatroom.files, *line.File)
+				}
+			}
+		}
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			client.log(err.Error())
+			return
+		}
+	}
+}
+
+// history from before it was kept line by line comes first
+func (client *Client) loadOldHistory(chatroom *chatroom) {
+	encoded, err := os.ReadFile(client.oldHistoryPath(chatroom.name))
+	if err != nil {
+		return
+	}
+
+	saved := savedHistory{}
+	err = json.Unmarshal(encoded, &saved)
+	if err != nil {
+		client.log("invalid history for " + chatroom.name + ": " + err.Error())
+		return
+	}
+
+	chatroom.history = append(chatroom.history, saved.History...)
+	chatroom.files = append(chatroom.files, saved.Files...)
+}
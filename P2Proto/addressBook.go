@@ -0,0 +1,199 @@
+package P2Proto
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// where known addresses are saved between runs, set before calling Setup
+var AddressBookPath = "addresses.json"
+
+// addresses that failed this many times in a row are forgotten
+var maxAddressFailures = 10
+
+// most addresses we keep, the least promising are forgotten first
+var maxKnownAddresses = 256
+
+// most known addresses Setup tries before the configured bootstrap addresses
+var maxKnownBootstrap = 8
+
+type AddressInfo struct {
+	LastSeen time.Time // zero if we have only heard of it
+	Failures int       // dial failures since we last saw it
+}
+
+var addressLock sync.Mutex
+var addressBook map[string]*AddressInfo // nil until loaded from disk
+
+// must hold addressLock
+func loadAddressBook() {
+	if addressBook != nil {
+		return
+	}
+	addressBook = make(map[string]*AddressInfo)
+
+	encoded, err := os.ReadFile(AddressBookPath)
+	if err != nil {
+		return // first run
+	}
+	err = json.Unmarshal(encoded, &addressBook)
+	if err != nil {
+		log("invalid address book: " + err.Error())
+		addressBook = make(map[string]*AddressInfo)
+	}
+}
+
+// must hold addressLock
+func saveAddressBook() {
+	encoded, err := json.Marshal(addressBook)
+	if err != nil {
+		log(err.Error())
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(AddressBookPath), 0700)
+	if err != nil {
+		log(err.Error())
+		return
+	}
+	err = os.WriteFile(AddressBookPath, encoded, 0600)
+	if err != nil {
+		log(err.Error())
+	}
+}
+
+func validPeerAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && port != "" && !isOwnAddress(addr)
+}
+
+// we were connected to addr
+func addressSeen(addr string) {
+	if !validPeerAddress(addr) {
+		return
+	}
+
+	addressLock.Lock()
+	defer addressLock.Unlock()
+	loadAddressBook()
+
+	if _, ok := addressBook[addr]; !ok {
+		makeRoomInAddressBook(true)
+	}
+	addressBook[addr] = &AddressInfo{LastSeen: time.Now()}
+	saveAddressBook()
+}
+
+// we heard of addrs from someone else, dont overwrite what we already know
+func addressesHeard(addrs []string) {
+	valid := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if validPeerAddress(addr) {
+			valid = append(valid, addr)
+		}
+	}
+
+	addressLock.Lock()
+	defer addressLock.Unlock()
+	loadAddressBook()
+
+	changed := false
+	for _, addr := range valid {
+		if _, ok := addressBook[addr]; ok {
+			continue
+		}
+		if !makeRoomInAddressBook(false) {
+			break
+		}
+		addressBook[addr] = &AddressInfo{}
+		changed = true
+	}
+	if changed { // once for the lot, a PEX can have dozens
+		saveAddressBook()
+	}
+}
+
+// must hold addressLock. forgets the least promising address if the book is full, false if nothing could go.
+// an address we have only heard of never pushes out one we have connected to
+func makeRoomInAddressBook(forSeen bool) bool {
+	if len(addressBook) < maxKnownAddresses {
+		return true
+	}
+	worst := ""
+	for addr, info := range addressBook {
+		if worst == "" || worseAddress(info, addressBook[worst]) {
+			worst = addr
+		}
+	}
+	if !forSeen && !addressBook[worst].LastSeen.IsZero() {
+		return false
+	}
+	delete(addressBook, worst)
+	return true
+}
+
+// heard of is worse than seen, then the most failures, then seen longest ago
+func worseAddress(a, b *AddressInfo) bool {
+	if a.LastSeen.IsZero() != b.LastSeen.IsZero() {
+		return a.LastSeen.IsZero()
+	}
+	if a.Failures != b.Failures {
+		return a.Failures > b.Failures
+	}
+	return a.LastSeen.Before(b.LastSeen)
+}
+
+func addressFailed(addr string) {
+	addressLock.Lock()
+	defer addressLock.Unlock()
+	loadAddressBook()
+
+	info, ok := addressBook[addr]
+	if !ok {
+		return
+	}
+	info.Failures++
+	if info.Failures >= maxAddressFailures {
+		delete(addressBook, addr)
+	}
+	saveAddressBook()
+}
+
+// known addresses, most promising first
+func KnownAddresses() []string {
+	addressLock.Lock()
+	defer addressLock.Unlock()
+	loadAddressBook()
+
+	addrs := make([]string, 0, len(addressBook))
+	for addr := range addressBook {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := addressBook[addrs[i]], addressBook[addrs[j]]
+		if a.Failures != b.Failures {
+			return a.Failures < b.Failures
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	return addrs
+}
+
+// addresses we have actually connected to and that have not failed since
+func goodAddresses() []string {
+	addressLock.Lock()
+	defer addressLock.Unlock()
+	loadAddressBook()
+
+	addrs := make([]string, 0)
+	for addr, info := range addressBook {
+		if !info.LastSeen.IsZero() && info.Failures == 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,41 @@
+package P2Proto
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func useTestAddressBook(t *testing.T) {
+	AddressBookPath = filepath.Join(t.TempDir(), "addresses.json")
+	addressLock.Lock()
+	addressBook = nil
+	addressLock.Unlock()
+}
+
+func TestAddressBookIsCapped(t *testing.T) {
+	useTestAddressBook(t)
+
+	addressSeen("192.0.2.1:1234")
+	heard := make([]string, 0)
+	for i := 0; i < 2*maxKnownAddresses; i++ {
+		heard = append(heard, "198.51.100.1:"+strconv.Itoa(1000+i))
+	}
+	addressesHeard(heard)
+
+	known := KnownAddresses()
+	if len(known) > maxKnownAddresses {
+		t.Fatalf("kept %d addresses, at most %d allowed", len(known), maxKnownAddresses)
+	}
+	if known[0] != "192.0.2.1:1234" {
+		t.Fatalf("addresses we only heard of pushed out one we connected to")
+	}
+
+	// the batch was saved, and loads back the same
+	addressLock.Lock()
+	addressBook = nil
+	addressLock.Unlock()
+	if reloaded := KnownAddresses(); len(reloaded) != len(known) {
+		t.Fatalf("reloaded %d addresses, saved %d", len(reloaded), len(known))
+	}
+}
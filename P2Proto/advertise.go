@@ -0,0 +1,302 @@
+package P2Proto
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// addresses others can reach us at, set before calling Setup. they come before any we find ourselves,
+// for when we are behind a port forward or proxy
+var AnnounceAddrs []string
+
+// most addresses we put in a CONN_REQ, or try from one
+var maxCandidateAddrs = 8
+
+// most addresses we use from what peers saw us at
+var maxObservedAddrs = 8
+
+// an observed address is only believed once this many different peers report it, so one peer cant make us
+// advertise junk or think another node's address is ours
+var minObservedReporters = 2
+
+// most peers we remember a report from, and how long a report counts for
+var maxObservedReports = 64
+var observedReportTTL = time.Hour
+
+type observedReport struct {
+	addr string
+	at   time.Time
+}
+
+var ourAddrsLock sync.Mutex
+var interfaceAddrs []string                           // from our network interfaces, loopback last
+var observedReports = make(map[string]observedReport) // GID of who reported -> where they reached us, their latest
+var relayObservedAddr string                          // where our relay sees us, we picked it so one report is enough
+
+// the addresses the listener can be reached at, IPv4 first since older nodes may not have IPv6
+func findInterfaceAddresses(l net.Listener) []string {
+	listenAddr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return []string{l.Addr().String()}
+	}
+	port := listenAddr.Port
+	if !listenAddr.IP.IsUnspecified() {
+		return []string{listenAddr.String()}
+	}
+
+	onlyIPv4 := listenAddr.IP.To4() != nil // listening on 0.0.0.0 rather than [::]
+
+	ipv4 := make([]string, 0)
+	ipv6 := make([]string, 0)
+	loopback := make([]string, 0)
+	interfaces, err := net.InterfaceAddrs()
+	if err != nil {
+		log(err.Error())
+	}
+	for _, interfaceAddr := range interfaces {
+		ipNet, ok := interfaceAddr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() { // link local addresses need a zone, which means nothing to other machines
+			continue
+		}
+		isIPv4 := ipNet.IP.To4() != nil
+		if onlyIPv4 && !isIPv4 {
+			continue
+		}
+
+		addr := (&net.TCPAddr{IP: ipNet.IP, Port: port}).String()
+		if ipNet.IP.IsLoopback() {
+			loopback = append(loopback, addr)
+		} else if isIPv4 {
+			ipv4 = append(ipv4, addr)
+		} else {
+			ipv6 = append(ipv6, addr)
+		}
+	}
+	if len(loopback) == 0 {
+		loopback = append(loopback, (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}).String())
+	}
+	return append(append(ipv4, ipv6...), loopback...)
+}
+
+// where others should try to reach us, best first. loopback addresses are only given if there is nothing else
+func ourAddresses() []string {
+	ourAddrsLock.Lock()
+	defer ourAddrsLock.Unlock()
+
+	observed := confirmedObservedAddrs()
+	if relayObservedAddr != "" {
+		observed = append([]string{relayObservedAddr}, observed...)
+	}
+
+	addrs := make([]string, 0)
+	loopback := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, list := range [][]string{AnnounceAddrs, observed, interfaceAddrs} {
+		for _, addr := range list {
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			if isLoopback(addr) {
+				loopback = append(loopback, addr)
+			} else {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return loopback
+	}
+	return addrs
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// true if addr leads to us
+func isOwnAddress(addr string) bool {
+	if addr == localAddress {
+		return true
+	}
+
+	ourAddrsLock.Lock()
+	defer ourAddrsLock.Unlock()
+	for _, list := range [][]string{AnnounceAddrs, interfaceAddrs, {relayObservedAddr}, confirmedObservedAddrs()} {
+		for _, own := range list {
+			if own != "" && addr == own {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// a peer told us (in a CONN_ACK) the address they reached us at
+func addressObserved(addr string, by string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" || by == "" {
+		return
+	}
+
+	ourAddrsLock.Lock()
+	defer ourAddrsLock.Unlock()
+	pruneObservedReports(time.Now())
+
+	if _, ok := observedReports[by]; !ok && len(observedReports) >= maxObservedReports {
+		evictObservedReport()
+	}
+	wasConfirmed := observedReporters()[addr] >= minObservedReporters
+	observedReports[by] = observedReport{addr: addr, at: time.Now()}
+	if !wasConfirmed && observedReporters()[addr] >= minObservedReporters {
+		log("peers reached us at " + addr)
+	}
+}
+
+// our relay told us the address our reservation came from
+func addressObservedByRelay(addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" {
+		return
+	}
+
+	ourAddrsLock.Lock()
+	defer ourAddrsLock.Unlock()
+	if relayObservedAddr != addr {
+		log("relay reached us at " + addr)
+	}
+	relayObservedAddr = addr
+}
+
+// must hold ourAddrsLock
+func pruneObservedReports(now time.Time) {
+	for by, report := range observedReports {
+		if now.Sub(report.at) > observedReportTTL {
+			delete(observedReports, by)
+		}
+	}
+}
+
+// must hold ourAddrsLock. how many peers reported each address
+func observedReporters() map[string]int {
+	counts := make(map[string]int)
+	for _, report := range observedReports {
+		counts[report.addr]++
+	}
+	return counts
+}
+
+// must hold ourAddrsLock. makes room by dropping the oldest report, one for an unconfirmed address if there is one
+func evictObservedReport() {
+	counts := observedReporters()
+	oldest := ""
+	for by, report := range observedReports {
+		if oldest == "" {
+			oldest = by
+			continue
+		}
+		current := observedReports[oldest]
+		confirmed := counts[report.addr] >= minObservedReporters
+		currentConfirmed := counts[current.addr] >= minObservedReporters
+		if confirmed != currentConfirmed {
+			if !confirmed {
+				oldest = by
+			}
+		} else if report.at.Before(current.at) {
+			oldest = by
+		}
+	}
+	delete(observedReports, oldest)
+}
+
+// must hold ourAddrsLock. addresses enough peers agree we are at, the most agreed on first
+func confirmedObservedAddrs() []string {
+	pruneObservedReports(time.Now())
+	counts := observedReporters()
+
+	confirmed := make([]string, 0)
+	for addr, count := range counts {
+		if count >= minObservedReporters {
+			confirmed = append(confirmed, addr)
+		}
+	}
+	sort.Slice(confirmed, func(i, j int) bool {
+		if counts[confirmed[i]] != counts[confirmed[j]] {
+			return counts[confirmed[i]] > counts[confirmed[j]]
+		}
+		return confirmed[i] < confirmed[j]
+	})
+	if len(confirmed) > maxObservedAddrs {
+		confirmed = confirmed[:maxObservedAddrs]
+	}
+	return confirmed
+}
+
+// the address a tmp connection came from, with the port the sender says it listens on
+func observedFrom(conn net.Conn, origin string) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(origin)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// records where a CONN_REQ was seen to come from, when sender (who handed it to us) is the node asking to connect.
+// nodes further along keep what the first one saw
+func addCandidate(packet Packet, addr string, sender string) Packet {
+	handshake, ok := packet.Payload.(Handshake)
+	if !ok || addr == "" || sender == "" || sender != handshake.GID {
+		return packet
+	}
+	handshake.ObservedAddr = addr
+	packet.Payload = handshake
+	return packet
+}
+
+// every address to try for the sender of a CONN_REQ, in order. where they were seen to come from goes first, it is
+// the one most likely to work through a NAT. the rest are whatever the sender claims, so only public ones and ones on
+// the host they were seen at are tried, otherwise anyone could have us dial hosts on our own network
+func candidateAddrs(packet Packet) []string {
+	handshake, _ := packet.Payload.(Handshake)
+	observedHost, _, _ := net.SplitHostPort(handshake.ObservedAddr)
+	addrs := append([]string{handshake.ObservedAddr, packet.Origin}, handshake.Addrs...)
+
+	candidates := make([]string, 0, len(addrs))
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if len(candidates) >= maxCandidateAddrs {
+			break
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" || port == "" || seen[addr] || isOwnAddress(addr) {
+			continue
+		}
+		if addr != handshake.ObservedAddr && host != observedHost && !isPublicIP(host) {
+			continue
+		}
+		seen[addr] = true
+		candidates = append(candidates, addr)
+	}
+	return candidates
+}
+
+func isPublicIP(host string) bool {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false // a name could point anywhere
+	}
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
@@ -0,0 +1,120 @@
+package P2Proto
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func resetObservedReports(t *testing.T) {
+	ourAddrsLock.Lock()
+	observedReports = make(map[string]observedReport)
+	relayObservedAddr = ""
+	ourAddrsLock.Unlock()
+	t.Cleanup(func() {
+		ourAddrsLock.Lock()
+		observedReports = make(map[string]observedReport)
+		ourAddrsLock.Unlock()
+	})
+}
+
+func TestObservedAddressNeedsTwoReporters(t *testing.T) {
+	resetObservedReports(t)
+
+	addressObserved("203.0.113.1:1234", "a")
+	addressObserved("203.0.113.1:1234", "a")
+	if isOwnAddress("203.0.113.1:1234") {
+		t.Fatalf("one peer was enough to make an address ours")
+	}
+
+	addressObserved("203.0.113.1:1234", "b")
+	if !isOwnAddress("203.0.113.1:1234") {
+		t.Fatalf("address reported by two peers is not ours")
+	}
+}
+
+func TestObservedReportsExpire(t *testing.T) {
+	resetObservedReports(t)
+
+	addressObserved("203.0.113.1:1234", "a")
+	addressObserved("203.0.113.1:1234", "b")
+	ourAddrsLock.Lock()
+	for by, report := range observedReports {
+		report.at = time.Now().Add(-2 * observedReportTTL)
+		observedReports[by] = report
+	}
+	ourAddrsLock.Unlock()
+
+	if isOwnAddress("203.0.113.1:1234") {
+		t.Fatalf("expired reports still count")
+	}
+}
+
+// one peer flooding us with GIDs cant push out an address others agree on
+func TestConfirmedAddressSurvivesJunk(t *testing.T) {
+	resetObservedReports(t)
+
+	addressObserved("203.0.113.1:1234", "a")
+	addressObserved("203.0.113.1:1234", "b")
+	for i := 0; i < 2*maxObservedReports; i++ {
+		addressObserved("198.51.100.1:"+strconv.Itoa(1000+i), "junk"+strconv.Itoa(i))
+	}
+
+	if !isOwnAddress("203.0.113.1:1234") {
+		t.Fatalf("junk reports evicted a confirmed address")
+	}
+	if isOwnAddress("198.51.100.1:1000") {
+		t.Fatalf("junk address counted as ours")
+	}
+	ourAddrsLock.Lock()
+	count := len(observedReports)
+	ourAddrsLock.Unlock()
+	if count > maxObservedReports {
+		t.Fatalf("remembered %d reports, at most %d allowed", count, maxObservedReports)
+	}
+}
+
+func connReqFrom(origin string, addrs []string) Packet {
+	return Packet{Type: CONN_REQ, Origin: origin, Payload: Handshake{GID: "them", Addrs: addrs}}
+}
+
+func TestObservedCandidateComesFirst(t *testing.T) {
+	resetObservedReports(t)
+
+	addrs := make([]string, 0)
+	for i := 0; i < 2*maxCandidateAddrs; i++ {
+		addrs = append(addrs, "198.51.100.1:"+strconv.Itoa(1000+i))
+	}
+	packet := addCandidate(connReqFrom("198.51.100.1:999", addrs), "203.0.113.5:999", "them")
+
+	candidates := candidateAddrs(packet)
+	if len(candidates) != maxCandidateAddrs || candidates[0] != "203.0.113.5:999" {
+		t.Fatalf("candidates are %v, expected the observed address first", candidates)
+	}
+}
+
+func TestCandidatesOnlyFromSender(t *testing.T) {
+	resetObservedReports(t)
+
+	packet := addCandidate(connReqFrom("198.51.100.1:999", nil), "203.0.113.5:999", "someone else")
+	if candidates := candidateAddrs(packet); len(candidates) != 1 || candidates[0] != "198.51.100.1:999" {
+		t.Fatalf("a node passing the request on set where it came from: %v", candidates)
+	}
+}
+
+// the addresses in a CONN_REQ are the sender's to choose, so private ones are only dialed on the host we saw them at
+func TestPrivateCandidatesSkipped(t *testing.T) {
+	resetObservedReports(t)
+
+	packet := connReqFrom("192.168.1.5:999", []string{"10.0.0.1:22", "127.0.0.1:6379", "localhost:80", "203.0.113.7:999"})
+	candidates := candidateAddrs(packet)
+	if len(candidates) != 1 || candidates[0] != "203.0.113.7:999" {
+		t.Fatalf("with nothing observed, tried %v", candidates)
+	}
+
+	packet = addCandidate(connReqFrom("192.168.1.5:999", []string{"192.168.1.5:1000", "192.168.1.6:1000"}), "192.168.1.5:999", "them")
+	candidates = candidateAddrs(packet)
+	if len(candidates) != 2 || candidates[0] != "192.168.1.5:999" || candidates[1] != "192.168.1.5:1000" {
+		t.Fatalf("on the host we saw them at, tried %v", candidates)
+	}
+}
@@ -0,0 +1,314 @@
+package P2Proto
+
+import (
+	"net"
+	"time"
+)
+
+// asks for a blob, sent towards whoever advertised it, or to everyone if nobody has
+type Want struct {
+	Hash string `wire:"1"`
+}
+
+// advertises blobs a node holds, passed on until it has travelled maxHaveHops
+type Have struct {
+	Hashes []string `wire:"1"`
+	Hops   int      `wire:"2"`
+}
+
+type Blob struct {
+	Hash string `wire:"1"`
+	Data []byte `wire:"2"`
+}
+
+var maxHaveHops = 3
+
+// how many of our blobs we tell a new peer about
+var maxHavesOnConnect = 1024
+
+// how long we remember who asked us for a blob we didnt have, and who said they had one
+var wantTimeout = time.Minute
+var haveTimeout = 10 * time.Minute
+
+type blobRoute struct {
+	peer *Peer
+	time time.Time
+}
+
+// all guarded by blobLock
+var blobRequesters = make(map[string][]blobRoute) // who to hand a blob back to when it arrives
+var blobProviders = make(map[string][]blobRoute)  // which peers lead to someone advertising the blob
+var ourWants = make(map[string]time.Time)         // blobs we asked for ourselves, and when
+
+func init() {
+	RegisterPayload(3, Want{})
+	RegisterPayload(4, Have{})
+	RegisterPayload(5, Blob{})
+}
+
+// asks the network for a blob, whoever has it will send it back along the path the request took
+func WantBlob(hash string) {
+	if HasBlob(hash) {
+		return
+	}
+
+	blobLock.Lock()
+	ourWants[hash] = time.Now()
+	blobLock.Unlock()
+
+	wantPacket := Packet{
+		Type:      WANT,
+		Origin:    localAddress,
+		Payload:   Want{Hash: hash},
+		Timestamp: time.Now().String(),
+	}
+	sendWant(wantPacket, nil)
+}
+
+// tells the network we hold these blobs
+func AnnounceBlobs(hashes []string) {
+	if len(hashes) == 0 {
+		return
+	}
+
+	havePacket := Packet{
+		Type:      HAVE,
+		Origin:    localAddress,
+		Payload:   Have{Hashes: hashes},
+		Timestamp: time.Now().String(),
+	}
+	announcePacket(havePacket)
+
+	go func() {
+		for _, hash := range hashes {
+			provide(hash)
+		}
+	}()
+}
+
+// lets a new peer know what it can fetch from us, they dont pass it on
+func sendHaves(peer *Peer) {
+	hashes := storedBlobs()
+	if len(hashes) == 0 {
+		return
+	}
+	if len(hashes) > maxHavesOnConnect {
+		hashes = hashes[:maxHavesOnConnect]
+	}
+
+	havePacket := Packet{
+		Type:      HAVE,
+		Origin:    localAddress,
+		Payload:   Have{Hashes: hashes, Hops: maxHaveHops},
+		Timestamp: time.Now().String(),
+	}
+	sendToPeer(peer, havePacket)
+}
+
+func recieveHave(packet Packet, from *Peer) {
+	have, ok := packet.Payload.(Have)
+	if !ok {
+		log("invalid HAVE from " + packet.Origin)
+		return
+	}
+
+	blobLock.Lock()
+	now := time.Now()
+	for _, hash := range have.Hashes {
+		if ValidBlobHash(hash) {
+			blobProviders[hash] = append(pruneRoutes(blobProviders[hash], from, haveTimeout), blobRoute{peer: from, time: now})
+		}
+	}
+	blobLock.Unlock()
+
+	if have.Hops < maxHaveHops {
+		have.Hops++
+		packet.Payload = have
+		for peer := range Peers {
+			if peer != from {
+				sendToPeer(peer, packet)
+			}
+		}
+	}
+}
+
+func recieveWant(packet Packet, from *Peer) {
+	want, ok := packet.Payload.(Want)
+	if !ok || !ValidBlobHash(want.Hash) {
+		log("invalid WANT from " + packet.Origin)
+		return
+	}
+
+	if data, ok := GetBlob(want.Hash); ok {
+		sendBlob(from, want.Hash, data)
+		return
+	}
+
+	// we dont have it, remember who asked and pass the request on
+	blobLock.Lock()
+	blobRequesters[want.Hash] = append(pruneRoutes(blobRequesters[want.Hash], from, wantTimeout), blobRoute{peer: from, time: time.Now()})
+	blobLock.Unlock()
+
+	sendWant(packet, from)
+}
+
+func recieveBlob(packet Packet, from *Peer) {
+	blob, ok := packet.Payload.(Blob)
+	if !ok {
+		log("invalid BLOB from " + packet.Origin)
+		return
+	}
+
+	if hashBlob(blob.Data) != blob.Hash {
+		log("dropping BLOB from " + packet.Origin + ", data does not match hash " + blob.Hash)
+		penalizePeer(from, offenseInvalid)
+		return
+	}
+
+	// only keep blobs someone asked for, otherwise anyone could fill our store and have us announce it
+	blobLock.Lock()
+	requesters := pruneRoutes(blobRequesters[blob.Hash], nil, wantTimeout)
+	delete(blobRequesters, blob.Hash)
+	wanted, ok := ourWants[blob.Hash]
+	solicited := len(requesters) > 0 || (ok && time.Since(wanted) < wantTimeout)
+	for hash, wanted := range ourWants {
+		if time.Since(wanted) >= wantTimeout {
+			delete(ourWants, hash)
+		}
+	}
+	blobLock.Unlock()
+
+	newBlob := !HasBlob(blob.Hash)
+	if !solicited {
+		if newBlob { // a second answer to a WANT is fine, one we never asked for is not
+			log("dropping BLOB " + blob.Hash + " from " + packet.Origin + ", nobody asked for it")
+			penalizePeer(from, offenseUnsolicited)
+		}
+		return
+	}
+	if newBlob {
+		_, err := StoreBlob(blob.Data)
+		if err != nil {
+			log(err.Error())
+		}
+	}
+
+	// hand it back to everyone who asked us for it
+
+	for _, requester := range requesters {
+		if requester.peer != from {
+			sendBlob(requester.peer, blob.Hash, blob.Data)
+		}
+	}
+
+	// we are now a provider too
+	if newBlob {
+		AnnounceBlobs([]string{blob.Hash})
+	}
+}
+
+// sends a WANT to the peer closest to an advertised holder, falling back to everyone but from
+func sendWant(packet Packet, from *Peer) {
+	want := packet.Payload.(Want)
+
+	blobLock.Lock()
+	blobProviders[want.Hash] = pruneRoutes(blobProviders[want.Hash], nil, haveTimeout)
+	var provider *Peer
+	for i := len(blobProviders[want.Hash]) - 1; i >= 0; i-- { // newest first
+		peer := blobProviders[want.Hash][i].peer
+		if _, connected := Peers[peer]; connected && peer != from {
+			provider = peer
+			break
+		}
+	}
+	blobLock.Unlock()
+
+	if provider != nil {
+		sendToPeer(provider, packet)
+		return
+	}
+
+	// our own request, see if the DHT knows who has it before asking everyone
+	if from == nil {
+		go func() {
+			if !wantFromDht(packet) {
+				floodWant(packet, nil)
+			}
+		}()
+		return
+	}
+
+	floodWant(packet, from)
+}
+
+func floodWant(packet Packet, from *Peer) {
+	for peer := range Peers {
+		if peer != from {
+			sendToPeer(peer, packet)
+		}
+	}
+}
+
+// asks each provider the DHT knows of for the blob directly, true once we have it
+func wantFromDht(packet Packet) bool {
+	want := packet.Payload.(Want)
+
+	for _, provider := range FindProviders(want.Hash) {
+		reply, ok := dhtExchange(provider.Addr, packet, true)
+		if !ok || reply.Type != BLOB {
+			continue
+		}
+		recieveBlob(reply, nil)
+		if HasBlob(want.Hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// answers a WANT that came in on a tmp connection
+func recieveTmpWant(conn net.Conn, packet Packet) {
+	want, ok := packet.Payload.(Want)
+	if !ok {
+		return
+	}
+	data, ok := GetBlob(want.Hash)
+	if !ok {
+		return
+	}
+
+	sendPacket(conn, Packet{
+		Type:      BLOB,
+		Origin:    localAddress,
+		Payload:   Blob{Hash: want.Hash, Data: data},
+		Timestamp: time.Now().String(),
+	})
+}
+
+func sendBlob(peer *Peer, hash string, data []byte) {
+	if peer == nil {
+		return
+	}
+	if _, ok := Peers[peer]; !ok { // peer has since disconnected
+		return
+	}
+
+	blobPacket := Packet{
+		Type:      BLOB,
+		Origin:    localAddress,
+		Payload:   Blob{Hash: hash, Data: data},
+		Timestamp: time.Now().String(),
+	}
+	sendToPeer(peer, blobPacket)
+}
+
+// drops routes that are too old or go through peer (so it can be re-added as the newest)
+func pruneRoutes(routes []blobRoute, peer *Peer, timeout time.Duration) []blobRoute {
+	kept := routes[:0]
+	for _, route := range routes {
+		if route.peer != peer && time.Since(route.time) < timeout {
+			kept = append(kept, route)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,43 @@
+package P2Proto
+
+import (
+	"testing"
+	"time"
+)
+
+func useTestBlobStore(t *testing.T) {
+	Peers = make(PeerList)
+	BlobDir = t.TempDir()
+	blobLock.Lock()
+	blobIndex = nil
+	ourWants = make(map[string]time.Time)
+	blobLock.Unlock()
+}
+
+func blobPacket(data []byte) Packet {
+	return Packet{Type: BLOB, Payload: Blob{Hash: hashBlob(data), Data: data}, Timestamp: time.Now().String()}
+}
+
+func TestUnsolicitedBlobDropped(t *testing.T) {
+	useTestBlobStore(t)
+
+	data := []byte("nobody asked")
+	recieveBlob(blobPacket(data), nil)
+	if HasBlob(hashBlob(data)) {
+		t.Fatalf("stored a blob we never asked for")
+	}
+}
+
+func TestWantedBlobStored(t *testing.T) {
+	useTestBlobStore(t)
+
+	data := []byte("we asked")
+	blobLock.Lock()
+	ourWants[hashBlob(data)] = time.Now()
+	blobLock.Unlock()
+
+	recieveBlob(blobPacket(data), nil)
+	if !HasBlob(hashBlob(data)) {
+		t.Fatalf("did not store a blob we asked for")
+	}
+}
@@ -0,0 +1,204 @@
+package P2Proto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blobs are content addressed, the key is the hex encoded SHA-256 of the data
+
+// where blobs are kept on disk, set before calling Setup
+var BlobDir = "blobs"
+
+// how many bytes of unpinned blobs we keep around before evicting the least recently used
+var BlobCacheLimit int64 = 256 * 1024 * 1024
+
+type blobEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+var blobLock sync.Mutex
+var blobIndex map[string]*blobEntry // nil until loaded from disk
+var pinnedBlobs = make(map[string]int)
+
+func hashBlob(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func blobPath(hash string) string {
+	return filepath.Join(BlobDir, hash)
+}
+
+// only accept hashes that could have come from hashBlob, so a hash can never escape BlobDir. for checking hashes
+// from the network before asking for them
+func ValidBlobHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size && strings.ToLower(hash) == hash
+}
+
+// must hold blobLock
+func loadBlobIndex() {
+	if blobIndex != nil {
+		return
+	}
+	blobIndex = make(map[string]*blobEntry)
+
+	files, err := os.ReadDir(BlobDir)
+	if err != nil {
+		return // nothing stored yet
+	}
+	for _, file := range files {
+		if !ValidBlobHash(file.Name()) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue // removed since we listed it
+		}
+		blobIndex[file.Name()] = &blobEntry{size: info.Size(), lastUsed: info.ModTime()}
+	}
+}
+
+// stores data in the local blob store and returns its hash
+func StoreBlob(data []byte) (string, error) {
+	hash := hashBlob(data)
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	loadBlobIndex()
+
+	if entry, ok := blobIndex[hash]; ok {
+		entry.lastUsed = time.Now()
+		return hash, nil
+	}
+
+	err := os.MkdirAll(BlobDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// write to a tmp file first so a half written blob is never mistaken for a whole one
+	tmpPath := blobPath(hash) + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmpPath, blobPath(hash))
+	if err != nil {
+		return "", err
+	}
+
+	blobIndex[hash] = &blobEntry{size: int64(len(data)), lastUsed: time.Now()}
+	evictBlobs()
+
+	return hash, nil
+}
+
+func HasBlob(hash string) bool {
+	if !ValidBlobHash(hash) {
+		return false
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	loadBlobIndex()
+
+	_, ok := blobIndex[hash]
+	return ok
+}
+
+func GetBlob(hash string) ([]byte, bool) {
+	if !ValidBlobHash(hash) {
+		return nil, false
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	loadBlobIndex()
+
+	entry, ok := blobIndex[hash]
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(blobPath(hash))
+	if err != nil {
+		delete(blobIndex, hash) // removed from under us
+		return nil, false
+	}
+	entry.lastUsed = time.Now()
+	return data, true
+}
+
+// pinned blobs are never evicted, pins are counted so each PinBlob needs its own UnpinBlob
+func PinBlob(hash string) {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	pinnedBlobs[hash]++
+}
+
+func UnpinBlob(hash string) {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	pinnedBlobs[hash]--
+	if pinnedBlobs[hash] <= 0 {
+		delete(pinnedBlobs, hash)
+	}
+	loadBlobIndex()
+	evictBlobs()
+}
+
+// hashes of the blobs we have, most recently used first
+func storedBlobs() []string {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	loadBlobIndex()
+
+	hashes := make([]string, 0, len(blobIndex))
+	for hash := range blobIndex {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return blobIndex[hashes[i]].lastUsed.After(blobIndex[hashes[j]].lastUsed)
+	})
+	return hashes
+}
+
+// removes least recently used unpinned blobs until the cache fits in BlobCacheLimit. must hold blobLock
+func evictBlobs() {
+	var cached int64
+	unpinned := make([]string, 0)
+	for hash, entry := range blobIndex {
+		if pinnedBlobs[hash] == 0 {
+			cached += entry.size
+			unpinned = append(unpinned, hash)
+		}
+	}
+	if cached <= BlobCacheLimit {
+		return
+	}
+
+	sort.Slice(unpinned, func(i, j int) bool {
+		return blobIndex[unpinned[i]].lastUsed.Before(blobIndex[unpinned[j]].lastUsed)
+	})
+	for _, hash := range unpinned {
+		if cached <= BlobCacheLimit {
+			break
+		}
+		err := os.Remove(blobPath(hash))
+		if err != nil && !os.IsNotExist(err) {
+			log(err.Error())
+			continue
+		}
+		cached -= blobIndex[hash].size
+		delete(blobIndex, hash)
+	}
+}
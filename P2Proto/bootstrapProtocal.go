@@ -1,9 +1,12 @@
 package P2Proto
 
 import (
-	"encoding/gob"
+	"bufio"
 	"io"
+	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,25 +22,52 @@ func listenForConnections(l net.Listener) {
 	}
 }
 
+// how long we try to reach an address before giving up on it
+var dialTimeout = 3 * time.Second
+
+// how long a tmp connection has to send its packet
+var tmpConnTimeout = 10 * time.Second
+
 // asynchronous function, for tmp connections before they become peers. only accepts one packet, then closes
 func handleConnection(conn net.Conn) {
 	log("handling connection: " + conn.RemoteAddr().String())
 
-	dec := gob.NewDecoder(conn)
+	conn.SetReadDeadline(time.Now().Add(tmpConnTimeout)) // dont wait forever on someone who never sends
+	reader := bufio.NewReader(conn)
 	carrier := &Carrier{}
-	err := dec.Decode(carrier) // blocking till we finish reading message
+	size, err := readCarrier(reader, carrier) // blocking till we finish reading message
+	conn.SetReadDeadline(time.Time{})
 
 	if err == io.EOF { // client disconnected
 		// do nothing, closing connection later
 	} else if err != nil { // error decoding message
 		log(err.Error())
+	} else if isBanned(conn.RemoteAddr().String()) || isBanned(carrier.Meta.GID) || isBanned(carrier.Packet.Origin) {
+		log("ignoring banned " + conn.RemoteAddr().String() + "(" + carrier.Meta.GID + ")")
+	} else if !allowOrigin(carrier.Packet, size, time.Now()) {
+		log("dropping packet from " + carrier.Packet.Origin + ", over the rate limit")
 	} else { // no errors, handle packet
 		switch carrier.Packet.Type {
 		case CONN_REQ:
-			recieveConnectionRequest(carrier.Packet)
+			// they may be behind a NAT, where they connected from could work better than what they think their address is
+			recieveConnectionRequest(addCandidate(carrier.Packet, observedFrom(conn, carrier.Packet.Origin), carrier.Meta.GID))
 		case CONN_ACK:
-			recieveConnectionAcknowledgment(conn, *carrier)
+			recieveConnectionAcknowledgment(conn, reader, *carrier)
 			return // we have handlePeer that deals with closing the connection now
+		case FIND_NODE, FIND_VALUE, STORE_VALUE:
+			recieveDhtRequest(conn, carrier.Packet)
+		case WANT:
+			recieveTmpWant(conn, carrier.Packet)
+		case DIRECT:
+			recievePacket(carrier.Packet, nil)
+		case CONN_REJECT:
+			recieveRejection(carrier.Packet)
+		case RELAY_RESERVE:
+			recieveRelayReservation(conn, reader, *carrier)
+			return // kept open for as long as they want it
+		case RELAY_CONNECT:
+			recieveRelayConnect(conn, reader, carrier.Packet)
+			return // the circuit closes it
 		}
 	}
 
@@ -45,7 +75,7 @@ func handleConnection(conn net.Conn) {
 	conn.Close()
 }
 
-func recieveConnectionAcknowledgment(conn net.Conn, carrier Carrier) {
+func recieveConnectionAcknowledgment(conn net.Conn, reader *bufio.Reader, carrier Carrier) {
 	// double check
 	if carrier.Packet.Type != CONN_ACK {
 		log("invalid function call, cannot handle packet not of type CONN_ACK")
@@ -54,74 +84,105 @@ func recieveConnectionAcknowledgment(conn net.Conn, carrier Carrier) {
 
 	log("got connection acknowledge from " + conn.RemoteAddr().String())
 
-	for peer := range Peers {
-		if carrier.Meta.GID == peer.Meta.GID {
-			log("already connected to " + conn.RemoteAddr().String() + "(" + carrier.Meta.GID + ")")
-			return
-		}
+	features, ok, reason := checkHandshake(carrier.Packet)
+	if !ok {
+		log("refusing " + conn.RemoteAddr().String() + "(" + carrier.Meta.GID + "), incompatible protocol: " + reason)
+		sendReject(conn, "incompatible protocol: "+reason)
+		conn.Close()
+		return
 	}
 
+	handshake := carrier.Packet.Payload.(Handshake) // checkHandshake made sure
+	addressObserved(handshake.ObservedAddr, carrier.Meta.GID)
+	addressesHeard(handshake.Addrs)
+
+	log("using features " + features.String() + " with " + carrier.Meta.GID)
 	newPeer := Peer{
 		Connection: conn,
 		Meta:       carrier.Meta,
+		Features:   features,
+		reader:     reader,
 	}
 	handlePeer(&newPeer)
 }
 
 // creates the connection to a machine
-func requestConnection(destinationAddr string) (net.Conn, bool) {
-	log("requesting connection to " + destinationAddr)
+func requestConnection(destinationAddr string, transport Transport) (net.Conn, bool) {
+	log("requesting connection to " + destinationAddr + " over " + transport.Name())
 	// verify you can connect
-	if destinationAddr == localAddress {
+	if isOwnAddress(destinationAddr) {
 		log("Cannot connect to yourself")
 		return nil, false
 	}
-	for peer := range Peers {
-		if destinationAddr == peer.Connection.RemoteAddr().String() { // FIX THIS, listening and writting port are different, may not the addrs as the same
-			log("Already connected to " + destinationAddr)
-			return nil, false
-		}
+	if isBanned(destinationAddr) {
+		log("Not connecting to banned " + destinationAddr)
+		return nil, false
+	}
+	if connectedTo(destinationAddr) {
+		log("Already connected to " + destinationAddr)
+		return nil, false
 	}
 
-	conn, err := net.Dial("tcp4", destinationAddr)
+	conn, err := transport.Dial(destinationAddr, dialTimeout)
 	if err != nil {
 		log(err.Error())
+		addressFailed(destinationAddr)
 		return nil, false
 	}
 	log("connection established with " + destinationAddr)
 	return conn, true
 }
 
+func connectedTo(addr string) bool {
+	for peer := range Peers {
+		// the connection only comes from their listen address if we dialed it
+		if addr == peer.Meta.listenAddress() || (peer.dialed && !peer.isRelayed() && addr == peer.Connection.RemoteAddr().String()) {
+			return true
+		}
+	}
+	return false
+}
+
 // creates connection, sends request, then closes. We will get a new connection if someone accepts
 // should only be used by a node not connected to any nodes, otherwise send request through peers
-func EnterNetwork(bootstrapIP string) {
-	tmpConn, ok := requestConnection(bootstrapIP)
+// returns false if we could not reach bootstrapIP
+func EnterNetwork(bootstrapIP string) bool {
+	tmpConn, ok := requestConnection(bootstrapIP, tcpTransport)
 	if !ok {
-		return
+		return false
 	}
 	sendConnReq(tmpConn)
 	tmpConn.Close()
 	log("closed connection to " + bootstrapIP + "\n")
+	return true
 }
 
-func sendAck(c net.Conn) {
+// reachedAt is the address we dialed them on, so they learn how others can reach them
+func sendAck(c net.Conn, reachedAt string) {
 	log("sending CONN_ACK to " + c.RemoteAddr().String())
+	handshake := myHandshake()
+	handshake.ObservedAddr = reachedAt
 	ack := Packet{
 		Type: CONN_ACK,
 		// ACK origin is recognized by the connetion it came over, no need for origin field
+		Payload:   handshake,
 		Timestamp: time.Now().String(),
 	}
 	sendPacket(c, ack)
 }
 
-func sendConnReq(c net.Conn) {
-	log("sending CONN_REQ to " + c.RemoteAddr().String())
-	connReq := Packet{
+func newConnReq() Packet {
+	return Packet{
 		Type:      CONN_REQ,
 		Origin:    localAddress,
+		Payload:   myHandshake(),
 		Timestamp: time.Now().String(),
 	}
-	sendPacket(c, connReq)
+}
+
+func sendConnReq(c net.Conn) {
+	log("sending CONN_REQ to " + c.RemoteAddr().String())
+	sendPacket(c, newConnReq())
 }
 
 func announceBlank() {
@@ -131,3 +192,82 @@ func announceBlank() {
 	}
 	announcePacket(blank)
 }
+
+// how many rounds through the bootstrap list before giving up, and how long to wait between them
+var BootstrapRounds = 6
+var bootstrapBaseDelay = time.Second
+var bootstrapMaxDelay = 30 * time.Second
+
+// how long we wait for someone to accept our CONN_REQ before trying the next address
+var acceptTimeout = 2 * time.Second
+
+var jitterLock sync.Mutex
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// tries each address in order until we are accepted into the network, retrying the whole list with backoff
+// blocks, returns true once we have a peer
+func Bootstrap(addrs []string) bool {
+	addrs = uniqueAddresses(addrs)
+	if len(addrs) == 0 {
+		log("no known peers, enter a bootstrap address to connect")
+		return false
+	}
+
+	for round := 0; round < BootstrapRounds; round++ {
+		if round > 0 {
+			delay := backoff(round)
+			log("bootstrap round " + strconv.Itoa(round) + " failed, retrying in " + delay.Round(time.Millisecond).String())
+			time.Sleep(delay)
+		}
+
+		for _, addr := range addrs {
+			if len(Peers) > 0 {
+				log("joined network")
+				return true
+			}
+
+			log("bootstrapping via " + addr + " (round " + strconv.Itoa(round+1) + "/" + strconv.Itoa(BootstrapRounds) + ")")
+			if !EnterNetwork(addr) {
+				continue
+			}
+
+			// give them a moment to accept us
+			for waited := time.Duration(0); waited < acceptTimeout && len(Peers) == 0; waited += 100 * time.Millisecond {
+				time.Sleep(100 * time.Millisecond)
+			}
+			if len(Peers) > 0 {
+				log("joined network via " + addr)
+				return true
+			}
+		}
+	}
+
+	log("could not join the network after " + strconv.Itoa(BootstrapRounds) + " rounds, enter a bootstrap address to try again")
+	return false
+}
+
+// exponential backoff with 50% jitter either way so nodes restarting together dont retry in lockstep
+func backoff(round int) time.Duration {
+	delay := bootstrapBaseDelay << uint(round-1)
+	if delay > bootstrapMaxDelay || delay <= 0 {
+		delay = bootstrapMaxDelay
+	}
+
+	jitterLock.Lock()
+	jitter := time.Duration(jitterRand.Int63n(int64(delay) + 1))
+	jitterLock.Unlock()
+
+	return delay/2 + jitter
+}
+
+func uniqueAddresses(addrs []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique
+}
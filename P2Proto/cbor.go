@@ -0,0 +1,391 @@
+package P2Proto
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// a small CBOR (RFC 8949) encoder and decoder, just what the wire format needs: integers, byte and text
+// strings, arrays, maps with integer keys, booleans and null. structs are maps keyed by their `wire` tags,
+// and interface{} values (payloads) are [tag, value] arrays using the tags given to RegisterPayload
+
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+const cborFalse = 20
+const cborTrue = 21
+const cborNull = 22
+
+const maxCborDepth = 32
+
+func cborAppendHead(buf []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major<<5|byte(n))
+	case n <= 0xff:
+		return append(buf, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return append(buf, major<<5|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		return append(buf, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		return append(buf, major<<5|27, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+			byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+type wireField struct {
+	key   uint64
+	index int
+}
+
+// the fields of a struct type that go on the wire, sorted by key
+func wireFields(t reflect.Type) []wireField {
+	fields := make([]wireField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("wire")
+		if tag == "" {
+			continue
+		}
+		key, err := strconv.ParseUint(tag, 10, 64)
+		if err != nil {
+			panic("invalid wire tag on " + t.Name() + "." + t.Field(i).Name)
+		}
+		fields = append(fields, wireField{key: key, index: i})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	return fields
+}
+
+func cborEncode(buf []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return append(buf, cborSimple<<5|cborNull), nil
+		}
+		if v.Kind() == reflect.Ptr {
+			return cborEncode(buf, v.Elem())
+		}
+		tag, ok := payloadTypes[v.Elem().Type()]
+		if !ok {
+			return nil, errors.New("payload type " + v.Elem().Type().String() + " is not registered")
+		}
+		buf = cborAppendHead(buf, cborArray, 2)
+		buf = cborAppendHead(buf, cborUint, tag)
+		return cborEncode(buf, v.Elem())
+	case reflect.Struct:
+		fields := wireFields(v.Type())
+		buf = cborAppendHead(buf, cborMap, uint64(len(fields)))
+		var err error
+		for _, field := range fields {
+			buf = cborAppendHead(buf, cborUint, field.key)
+			buf, err = cborEncode(buf, v.Field(field.index))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf = cborAppendHead(buf, cborBytes, uint64(v.Len()))
+			return append(buf, v.Bytes()...), nil
+		}
+		buf = cborAppendHead(buf, cborArray, uint64(v.Len()))
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			buf, err = cborEncode(buf, v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.String:
+		buf = cborAppendHead(buf, cborText, uint64(v.Len()))
+		return append(buf, v.String()...), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, cborSimple<<5|cborTrue), nil
+		}
+		return append(buf, cborSimple<<5|cborFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n < 0 {
+			return cborAppendHead(buf, cborNegInt, uint64(-1-n)), nil
+		}
+		return cborAppendHead(buf, cborUint, uint64(n)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cborAppendHead(buf, cborUint, v.Uint()), nil
+	}
+	return nil, errors.New("cannot encode " + v.Type().String())
+}
+
+type cborDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+var errCborTruncated = errors.New("cbor: unexpected end of data")
+
+func (d *cborDecoder) remaining() int {
+	return len(d.data) - d.pos
+}
+
+func (d *cborDecoder) readHead() (byte, uint64, error) {
+	if d.remaining() < 1 {
+		return 0, 0, errCborTruncated
+	}
+	first := d.data[d.pos]
+	d.pos++
+	major, info := first>>5, first&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, errors.New("cbor: indefinite lengths are not supported")
+	}
+
+	if d.remaining() < size {
+		return 0, 0, errCborTruncated
+	}
+	var n uint64
+	for _, b := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.pos += size
+	return major, n, nil
+}
+
+// checks a length read from a head could fit in what is left, before we allocate for it.
+// every item takes at least one byte, so n items need at least n bytes
+func (d *cborDecoder) checkLength(n uint64) error {
+	if n > uint64(d.remaining()) {
+		return errCborTruncated
+	}
+	return nil
+}
+
+func (d *cborDecoder) decode(v reflect.Value) error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxCborDepth {
+		return errors.New("cbor: nested too deeply")
+	}
+
+	start := d.pos
+	major, n, err := d.readHead()
+	if err != nil {
+		return err
+	}
+
+	if major == cborSimple && n == cborNull {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if major != cborArray || n != 2 {
+			return errors.New("cbor: payload must be a [tag, value] array")
+		}
+		tagMajor, tag, err := d.readHead()
+		if err != nil {
+			return err
+		}
+		t, ok := payloadTags[tag]
+		if tagMajor != cborUint || !ok {
+			return errors.New("cbor: unknown payload tag " + strconv.FormatUint(tag, 10))
+		}
+		payload := reflect.New(t).Elem()
+		err = d.decode(payload)
+		if err != nil {
+			return err
+		}
+		v.Set(payload)
+		return nil
+	case reflect.Ptr:
+		d.pos = start
+		v.Set(reflect.New(v.Type().Elem()))
+		return d.decode(v.Elem())
+	case reflect.Struct:
+		if major != cborMap {
+			return errors.New("cbor: expected map for " + v.Type().String())
+		}
+		if err := d.checkLength(n); err != nil {
+			return err
+		}
+		fields := make(map[uint64]int)
+		for _, field := range wireFields(v.Type()) {
+			fields[field.key] = field.index
+		}
+		for i := uint64(0); i < n; i++ {
+			keyMajor, key, err := d.readHead()
+			if err != nil {
+				return err
+			}
+			if keyMajor != cborUint {
+				return errors.New("cbor: map keys must be unsigned integers")
+			}
+			index, known := fields[key]
+			if !known {
+				err = d.skip() // from a newer version, ignore it
+			} else {
+				err = d.decode(v.Field(index))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if major != cborBytes {
+				return errors.New("cbor: expected byte string for " + v.Type().String())
+			}
+			if err := d.checkLength(n); err != nil {
+				return err
+			}
+			data := reflect.MakeSlice(v.Type(), int(n), int(n))
+			reflect.Copy(data, reflect.ValueOf(d.data[d.pos:d.pos+int(n)]))
+			d.pos += int(n)
+			v.Set(data)
+			return nil
+		}
+		if major != cborArray {
+			return errors.New("cbor: expected array for " + v.Type().String())
+		}
+		if err := d.checkLength(n); err != nil {
+			return err
+		}
+		items := reflect.MakeSlice(v.Type(), int(n), int(n))
+		for i := 0; i < int(n); i++ {
+			err := d.decode(items.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(items)
+		return nil
+	case reflect.String:
+		if major != cborText {
+			return errors.New("cbor: expected text for " + v.Type().String())
+		}
+		if err := d.checkLength(n); err != nil {
+			return err
+		}
+		text := d.data[d.pos : d.pos+int(n)]
+		if !utf8.Valid(text) {
+			return errors.New("cbor: invalid utf-8 in text")
+		}
+		d.pos += int(n)
+		v.SetString(string(text))
+		return nil
+	case reflect.Bool:
+		if major != cborSimple || (n != cborTrue && n != cborFalse) {
+			return errors.New("cbor: expected bool")
+		}
+		v.SetBool(n == cborTrue)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var value int64
+		switch {
+		case major == cborUint && n <= 1<<63-1:
+			value = int64(n)
+		case major == cborNegInt && n <= 1<<63-1:
+			value = -1 - int64(n)
+		default:
+			return errors.New("cbor: expected integer for " + v.Type().String())
+		}
+		if v.OverflowInt(value) {
+			return errors.New("cbor: integer overflows " + v.Type().String())
+		}
+		v.SetInt(value)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if major != cborUint {
+			return errors.New("cbor: expected unsigned integer for " + v.Type().String())
+		}
+		if v.OverflowUint(n) {
+			return errors.New("cbor: integer overflows " + v.Type().String())
+		}
+		v.SetUint(n)
+		return nil
+	}
+	return errors.New("cbor: cannot decode into " + v.Type().String())
+}
+
+// moves past one item without decoding it
+func (d *cborDecoder) skip() error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxCborDepth {
+		return errors.New("cbor: nested too deeply")
+	}
+
+	major, n, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		if err := d.checkLength(n); err != nil {
+			return err
+		}
+		d.pos += int(n)
+	case cborArray, cborMap:
+		if err := d.checkLength(n); err != nil {
+			return err
+		}
+		if major == cborMap {
+			n *= 2
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return d.skip()
+	}
+	return nil
+}
+
+func cborMarshal(v interface{}) ([]byte, error) {
+	return cborEncode(nil, reflect.ValueOf(v))
+}
+
+// v must be a pointer, all of data must be used
+func cborUnmarshal(data []byte, v interface{}) error {
+	d := &cborDecoder{data: data}
+	err := d.decode(reflect.ValueOf(v).Elem())
+	if err != nil {
+		return err
+	}
+	if d.remaining() != 0 {
+		return errors.New("cbor: trailing data")
+	}
+	return nil
+}
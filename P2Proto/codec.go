@@ -0,0 +1,188 @@
+package P2Proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"reflect"
+)
+
+// how carriers are turned into bytes on the wire. every node can read both codecs (see readCarrier),
+// WireCodec only decides what we send, so gob can be kept while older nodes are upgraded
+type Codec interface {
+	Encode(w io.Writer, carrier Carrier) error
+	Decode(r *bufio.Reader, carrier *Carrier) error
+}
+
+// set before calling Setup
+var WireCodec Codec = CBORCodec{}
+
+// the biggest encoded carrier we send or accept, a peer sending more is dropped
+var MaxCarrierSize = 4 << 20
+
+var errCarrierTooBig = errors.New("carrier is bigger than MaxCarrierSize")
+
+// payloads are tagged with a number naming their type, so any language can decode them.
+// tags below 64 are used by P2Proto, applications register their own payloads from 64 up
+var payloadTags = make(map[uint64]reflect.Type)
+var payloadTypes = make(map[reflect.Type]uint64)
+
+func RegisterPayload(tag uint64, example interface{}) {
+	t := reflect.TypeOf(example)
+	if existing, ok := payloadTags[tag]; ok && existing != t {
+		panic("payload tag " + t.String() + " already used by " + existing.String())
+	}
+	payloadTags[tag] = t
+	payloadTypes[t] = tag
+
+	gob.Register(example)
+}
+
+// gob, what we used before the CBOR wire format
+type GobCodec struct{}
+
+func (GobCodec) Encode(w io.Writer, carrier Carrier) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(carrier)
+	if err != nil {
+		return err
+	}
+	if buf.Len() > MaxCarrierSize {
+		return errCarrierTooBig
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (GobCodec) Decode(r *bufio.Reader, carrier *Carrier) error {
+	return gob.NewDecoder(&limitedReader{r: r, n: MaxCarrierSize}).Decode(carrier)
+}
+
+// stops gob reading more than n bytes. it is a ByteReader so gob uses it directly and never reads ahead
+type limitedReader struct {
+	r *bufio.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errCarrierTooBig
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+func (l *limitedReader) ReadByte() (byte, error) {
+	if l.n <= 0 {
+		return 0, errCarrierTooBig
+	}
+	l.n--
+	return l.r.ReadByte()
+}
+
+// CBOR frames start with cborFrameMagic, a byte that can never start a gob stream,
+// followed by the length of the CBOR body as a 4 byte big endian integer. see wire.cddl for the schema.
+// frames starting with compressedFrameMagic are the same but the body is deflated
+type CBORCodec struct {
+	Compress bool // deflate bodies over CompressThreshold, only for peers that support FEATURE_COMPRESSION
+}
+
+const cborFrameMagic = 0xC3
+const compressedFrameMagic = 0xC4
+
+func (c CBORCodec) Encode(w io.Writer, carrier Carrier) error {
+	body, err := cborEncode(nil, reflect.ValueOf(carrier))
+	if err != nil {
+		return err
+	}
+	if len(body) > MaxCarrierSize { // the reciever wont inflate it past that
+		return errCarrierTooBig
+	}
+	magic := byte(cborFrameMagic)
+	if c.Compress && len(body) >= CompressThreshold {
+		if compressed, smaller := deflate(body); smaller {
+			body = compressed
+			magic = compressedFrameMagic
+		}
+	}
+
+	frame := make([]byte, 5, 5+len(body))
+	frame[0] = magic
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(body)))
+	frame = append(frame, body...)
+
+	_, err = w.Write(frame) // in one write so frames from different goroutines dont interleave
+	return err
+}
+
+func (CBORCodec) Decode(r *bufio.Reader, carrier *Carrier) error {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != cborFrameMagic && header[0] != compressedFrameMagic {
+		return errors.New("not a CBOR frame")
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if uint64(size) > uint64(MaxCarrierSize) {
+		return errCarrierTooBig
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if header[0] == compressedFrameMagic {
+		body, err = inflate(body)
+		if err != nil {
+			return err
+		}
+	}
+	return cborUnmarshal(body, carrier)
+}
+
+// reads the next carrier in whichever codec the sender used, returning how many bytes it took up
+func readCarrier(r *bufio.Reader, carrier *Carrier) (int, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if first[0] == cborFrameMagic || first[0] == compressedFrameMagic {
+		size := 0
+		header, err := r.Peek(5)
+		if err == nil {
+			size = 5 + int(binary.BigEndian.Uint32(header[1:]))
+		}
+		return size, CBORCodec{}.Decode(r, carrier)
+	}
+
+	limited := &limitedReader{r: r, n: MaxCarrierSize}
+	err = gob.NewDecoder(limited).Decode(carrier)
+	return MaxCarrierSize - limited.n, err
+}
+
+func writeCarrier(w io.Writer, carrier Carrier) error {
+	return WireCodec.Encode(w, carrier)
+}
+
+// like writeCarrier, but compressed if the peer supports it. w is the peer's connection or one of its streams
+func writePeerCarrier(peer *Peer, w io.Writer, carrier Carrier) error {
+	codec := WireCodec
+	if cbor, ok := codec.(CBORCodec); ok && peer.supports(FEATURE_COMPRESSION) {
+		cbor.Compress = true
+		codec = cbor
+	}
+	return codec.Encode(w, carrier)
+}
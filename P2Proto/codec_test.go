@@ -0,0 +1,142 @@
+package P2Proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func exampleCarriers() []Carrier {
+	meta := PeerMeta{ConnectionCount: 3, GID: "127.0.0.1:1234"}
+	return []Carrier{
+		{Packet: Packet{Type: BLANK, Origin: "127.0.0.1:1234", Timestamp: "now"}, Meta: meta},
+		{Packet: Packet{Type: CONN_REQ, Origin: "127.0.0.1:1234", Payload: myHandshake(), Timestamp: "now"}, Meta: meta},
+		{Packet: Packet{Type: HAVE, Origin: "[::1]:1234", Payload: Have{Hashes: []string{"ab", "cd"}, Hops: 2}}, Meta: meta},
+		{Packet: Packet{Type: BLOB, Payload: Blob{Hash: "ab", Data: []byte{0, 1, 2, 0xff}}}},
+		{Packet: Packet{Type: NODES, Payload: DhtResponse{Contacts: []Contact{{GID: "a", Addr: "b"}}}}},
+		{Packet: Packet{Type: PUBLISH, Topic: "topic", Payload: IHave{Topic: "topic", IDs: []string{"x"}}}},
+		{Packet: Packet{Type: BLOB, Payload: Blob{Hash: "zeros", Data: make([]byte, 4096)}}}, // compresses well
+	}
+}
+
+// the carrier decoded from data must encode and decode back to the same bytes
+func FuzzCborCarrier(f *testing.F) {
+	for _, carrier := range exampleCarriers() {
+		encoded, err := cborMarshal(carrier)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encoded)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := Carrier{}
+		if cborUnmarshal(data, &decoded) != nil {
+			return
+		}
+
+		first, err := cborMarshal(decoded)
+		if err != nil {
+			t.Fatalf("could not encode decoded carrier: %v", err)
+		}
+		again := Carrier{}
+		err = cborUnmarshal(first, &again)
+		if err != nil {
+			t.Fatalf("could not decode encoded carrier: %v", err)
+		}
+		second, err := cborMarshal(again)
+		if err != nil {
+			t.Fatalf("could not encode decoded carrier: %v", err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("encoding changed after a round trip\n%x\n%x", first, second)
+		}
+	})
+}
+
+// reads a stream of frames in either codec, it must end in an error and never hang or panic
+func FuzzReadCarrier(f *testing.F) {
+	for _, carrier := range exampleCarriers() {
+		for _, codec := range []Codec{CBORCodec{}, CBORCodec{Compress: true}, GobCodec{}} {
+			buf := &bytes.Buffer{}
+			err := codec.Encode(buf, carrier)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	f.Add([]byte{cborFrameMagic, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for i := 0; i <= len(data); i++ {
+			if _, err := readCarrier(r, &Carrier{}); err != nil {
+				return
+			}
+		}
+		t.Fatalf("read more carriers than there are bytes")
+	})
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{CBORCodec{}, CBORCodec{Compress: true}, GobCodec{}} {
+		buf := &bytes.Buffer{}
+		for _, carrier := range exampleCarriers() {
+			err := codec.Encode(buf, carrier)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r := bufio.NewReader(buf)
+		for _, want := range exampleCarriers() {
+			got := Carrier{}
+			_, err := readCarrier(r, &got)
+			if err != nil {
+				t.Fatalf("%T: %v", codec, err)
+			}
+			if got.Packet.Type != want.Packet.Type || got.Meta != want.Meta {
+				t.Fatalf("%T: got %+v, want %+v", codec, got, want)
+			}
+		}
+	}
+}
+
+func TestCompressedFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	carrier := exampleCarriers()[len(exampleCarriers())-1]
+	err := CBORCodec{Compress: true}.Encode(buf, carrier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Bytes()[0] != compressedFrameMagic || buf.Len() > 1024 {
+		t.Fatalf("4KB of zeros was not compressed, frame is %d bytes", buf.Len())
+	}
+
+	got := Carrier{}
+	_, err = readCarrier(bufio.NewReader(buf), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Packet.Payload.(Blob).Data, make([]byte, 4096)) {
+		t.Fatalf("compressed blob came back different")
+	}
+}
+
+func TestCarrierTooBig(t *testing.T) {
+	big := Carrier{Packet: Packet{Type: BLOB, Payload: Blob{Data: make([]byte, MaxCarrierSize)}}}
+	for _, codec := range []Codec{CBORCodec{}, CBORCodec{Compress: true}, GobCodec{}} {
+		if codec.Encode(&bytes.Buffer{}, big) != errCarrierTooBig {
+			t.Fatalf("%T sent a carrier bigger than MaxCarrierSize", codec)
+		}
+	}
+
+	frame := []byte{cborFrameMagic, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(MaxCarrierSize+1))
+	_, err := readCarrier(bufio.NewReader(bytes.NewReader(frame)), &Carrier{})
+	if err != errCarrierTooBig {
+		t.Fatalf("accepted a frame bigger than MaxCarrierSize: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package P2Proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// frames smaller than this arent worth compressing
+var CompressThreshold = 512
+
+type CompressionStats struct {
+	Frames int64 // frames we sent compressed
+	Before int64 // their size before compression
+	After  int64 // and after
+}
+
+var compressionLock sync.Mutex
+var compressionStats CompressionStats
+
+// returns the compressed data, and if it came out smaller
+func deflate(data []byte) ([]byte, bool) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, false
+	}
+	w.Write(data)
+	w.Close()
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+
+	compressionLock.Lock()
+	compressionStats.Frames++
+	compressionStats.Before += int64(len(data))
+	compressionStats.After += int64(buf.Len())
+	compressionLock.Unlock()
+	return buf.Bytes(), true
+}
+
+// never inflates past MaxCarrierSize, so a small frame cant expand into a huge one
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	inflated, err := io.ReadAll(io.LimitReader(r, int64(MaxCarrierSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > MaxCarrierSize {
+		return nil, errCarrierTooBig
+	}
+	return inflated, nil
+}
+
+// how much compression has saved us sending
+func Compression() CompressionStats {
+	compressionLock.Lock()
+	defer compressionLock.Unlock()
+	return compressionStats
+}
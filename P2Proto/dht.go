@@ -0,0 +1,201 @@
+package P2Proto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kademlia style routing table, every node and every key lives in the same 256 bit ID space
+
+const dhtK = 8     // contacts per bucket, and how many closest nodes a lookup returns
+const dhtAlpha = 3 // queries in flight during a lookup
+
+// contacts not heard from in this long can be replaced when their bucket is full
+var contactStaleTime = 15 * time.Minute
+
+// how long we hold provider records others store with us
+var providerExpiry = time.Hour
+var maxProvidersPerKey = 20
+
+type nodeID [sha256.Size]byte
+
+type Contact struct {
+	GID  string `wire:"1"`
+	Addr string `wire:"2"`
+}
+
+type bucketEntry struct {
+	contact  Contact
+	lastSeen time.Time
+}
+
+var dhtLock sync.Mutex
+var buckets [sha256.Size * 8][]bucketEntry                   // bucket i holds contacts whose ID shares i leading bits with ours
+var providerRecords = make(map[string]map[Contact]time.Time) // key -> who provides it -> when the record expires
+
+func hashID(s string) nodeID {
+	return nodeID(sha256.Sum256([]byte(s)))
+}
+
+func (id nodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func parseID(s string) (nodeID, bool) {
+	id := nodeID{}
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != len(id) {
+		return id, false
+	}
+	copy(id[:], decoded)
+	return id, true
+}
+
+func xorDistance(a, b nodeID) nodeID {
+	distance := nodeID{}
+	for i := range a {
+		distance[i] = a[i] ^ b[i]
+	}
+	return distance
+}
+
+// true if a is closer to target than b
+func closer(target, a, b nodeID) bool {
+	da, db := xorDistance(target, a), xorDistance(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+func bucketIndex(id nodeID) int {
+	distance := xorDistance(hashID(GID), id)
+	for i, b := range distance {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return len(buckets) - 1 // ourselves, never stored
+}
+
+// records that we heard from contact, keeping each bucket in least recently seen order
+func addContact(contact Contact) {
+	if contact.GID == "" || contact.Addr == "" || contact.GID == GID {
+		return
+	}
+
+	dhtLock.Lock()
+	defer dhtLock.Unlock()
+
+	index := bucketIndex(hashID(contact.GID))
+	bucket := buckets[index]
+	for i, entry := range bucket {
+		if entry.contact.GID == contact.GID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+
+	if len(bucket) >= dhtK {
+		// prefer long lived contacts, only replace the oldest one if it has gone quiet
+		if time.Since(bucket[0].lastSeen) < contactStaleTime {
+			buckets[index] = bucket
+			return
+		}
+		bucket = bucket[1:]
+	}
+	buckets[index] = append(bucket, bucketEntry{contact: contact, lastSeen: time.Now()})
+}
+
+func removeContact(contact Contact) {
+	dhtLock.Lock()
+	defer dhtLock.Unlock()
+
+	index := bucketIndex(hashID(contact.GID))
+	for i, entry := range buckets[index] {
+		if entry.contact.GID == contact.GID {
+			buckets[index] = append(buckets[index][:i], buckets[index][i+1:]...)
+			return
+		}
+	}
+}
+
+// the count contacts we know closest to target
+func closestContacts(target nodeID, count int) []Contact {
+	dhtLock.Lock()
+	contacts := make([]Contact, 0)
+	for _, bucket := range buckets {
+		for _, entry := range bucket {
+			contacts = append(contacts, entry.contact)
+		}
+	}
+	dhtLock.Unlock()
+
+	sortByDistance(target, contacts)
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	return contacts
+}
+
+func sortByDistance(target nodeID, contacts []Contact) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return closer(target, hashID(contacts[i].GID), hashID(contacts[j].GID))
+	})
+}
+
+func storeProvider(key string, contact Contact) {
+	if key == "" || contact.GID == "" || contact.Addr == "" {
+		return
+	}
+
+	dhtLock.Lock()
+	defer dhtLock.Unlock()
+
+	providers, ok := providerRecords[key]
+	if !ok {
+		providers = make(map[Contact]time.Time)
+		providerRecords[key] = providers
+	}
+	expireProviders(providers)
+	if _, exists := providers[contact]; !exists && len(providers) >= maxProvidersPerKey {
+		return
+	}
+	providers[contact] = time.Now().Add(providerExpiry)
+}
+
+func lookupProviders(key string) []Contact {
+	dhtLock.Lock()
+	defer dhtLock.Unlock()
+
+	providers, ok := providerRecords[key]
+	if !ok {
+		return nil
+	}
+	expireProviders(providers)
+	if len(providers) == 0 {
+		delete(providerRecords, key)
+		return nil
+	}
+
+	found := make([]Contact, 0, len(providers))
+	for contact := range providers {
+		found = append(found, contact)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].GID < found[j].GID
+	})
+	return found
+}
+
+// must hold dhtLock
+func expireProviders(providers map[Contact]time.Time) {
+	now := time.Now()
+	for contact, expiry := range providers {
+		if now.After(expiry) {
+			delete(providers, contact)
+		}
+	}
+}
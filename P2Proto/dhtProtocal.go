@@ -0,0 +1,326 @@
+package P2Proto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// DHT requests are not routed through peers, the requester dials the contact directly,
+// sends one request and reads one reply on that tmp connection (see handleConnection)
+
+type DhtRequest struct {
+	Sender Contact `wire:"1"`
+	Target string  `wire:"2"` // hex ID for FIND_NODE
+	Key    string  `wire:"3"` // for FIND_VALUE, and STORE_VALUE which stores Sender as a provider of Key
+}
+
+type DhtResponse struct {
+	Contacts  []Contact `wire:"1"`
+	Providers []Contact `wire:"2"`
+}
+
+var dhtDialTimeout = 2 * time.Second
+var dhtRequestTimeout = 5 * time.Second
+
+// keys we have Provided, re-stored periodically since records expire
+var providedLock sync.Mutex
+var provided = make(map[string]bool)
+var republishInterval = 20 * time.Minute
+var lastRefresh time.Time
+
+func init() {
+	RegisterPayload(7, DhtRequest{})
+	RegisterPayload(8, DhtResponse{})
+}
+
+func myContact() Contact {
+	return Contact{GID: GID, Addr: localAddress}
+}
+
+func contactForPeer(peer *Peer) Contact {
+	return Contact{GID: peer.Meta.GID, Addr: peer.Meta.listenAddress()}
+}
+
+// answers a DHT request that came in on a tmp connection
+func recieveDhtRequest(conn net.Conn, packet Packet) {
+	request, ok := packet.Payload.(DhtRequest)
+	if !ok {
+		log("invalid DHT request from " + conn.RemoteAddr().String())
+		return
+	}
+	addContact(request.Sender)
+
+	switch packet.Type {
+	case FIND_NODE:
+		target, ok := parseID(request.Target)
+		if !ok {
+			return
+		}
+		sendDhtResponse(conn, DhtResponse{Contacts: closestContacts(target, dhtK)})
+	case FIND_VALUE:
+		sendDhtResponse(conn, DhtResponse{
+			Contacts:  closestContacts(hashID(request.Key), dhtK),
+			Providers: lookupProviders(request.Key),
+		})
+	case STORE_VALUE:
+		storeProvider(request.Key, request.Sender)
+	}
+}
+
+func sendDhtResponse(conn net.Conn, response DhtResponse) {
+	sendPacket(conn, Packet{
+		Type:      NODES,
+		Origin:    localAddress,
+		Payload:   response,
+		Timestamp: time.Now().String(),
+	})
+}
+
+// sends one packet to addr on a tmp connection, and reads the reply if expectReply
+func dhtExchange(addr string, packet Packet, expectReply bool) (Packet, bool) {
+	conn, err := tcpTransport.Dial(addr, dhtDialTimeout)
+	if err != nil {
+		return Packet{}, false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dhtRequestTimeout))
+
+	err = writeCarrier(conn, Carrier{Packet: packet, Meta: getMyMeta()})
+	if err != nil || !expectReply {
+		return Packet{}, err == nil
+	}
+
+	carrier := &Carrier{}
+	_, err = readCarrier(bufio.NewReader(conn), carrier)
+	if err != nil {
+		return Packet{}, false
+	}
+	return carrier.Packet, true
+}
+
+func dhtQuery(contact Contact, packetType PacketType, request DhtRequest) (DhtResponse, bool) {
+	request.Sender = myContact()
+	reply, ok := dhtExchange(contact.Addr, Packet{
+		Type:      packetType,
+		Origin:    localAddress,
+		Payload:   request,
+		Timestamp: time.Now().String(),
+	}, true)
+	if !ok {
+		removeContact(contact)
+		return DhtResponse{}, false
+	}
+
+	response, ok := reply.Payload.(DhtResponse)
+	if !ok || reply.Type != NODES {
+		return DhtResponse{}, false
+	}
+	addContact(contact)
+	return response, true
+}
+
+// iterative Kademlia lookup. finds the dhtK closest nodes to target, and if key is set, who provides it
+func lookup(target nodeID, key string) ([]Contact, []Contact) {
+	shortlist := closestContacts(target, dhtK)
+	queried := map[string]bool{GID: true}
+	providers := make([]Contact, 0)
+
+	type result struct {
+		contact  Contact
+		response DhtResponse
+		ok       bool
+	}
+
+	for {
+		// the closest contacts we have not asked yet
+		toQuery := make([]Contact, 0, dhtAlpha)
+		for _, contact := range shortlist {
+			if len(toQuery) >= dhtAlpha {
+				break
+			}
+			if !queried[contact.GID] {
+				toQuery = append(toQuery, contact)
+				queried[contact.GID] = true
+			}
+		}
+		if len(toQuery) == 0 {
+			break
+		}
+
+		results := make(chan result, len(toQuery))
+		for _, contact := range toQuery {
+			go func(contact Contact) {
+				var response DhtResponse
+				var ok bool
+				if key == "" {
+					response, ok = dhtQuery(contact, FIND_NODE, DhtRequest{Target: target.String()})
+				} else {
+					response, ok = dhtQuery(contact, FIND_VALUE, DhtRequest{Key: key})
+				}
+				results <- result{contact: contact, response: response, ok: ok}
+			}(contact)
+		}
+
+		for range toQuery {
+			r := <-results
+			if !r.ok {
+				shortlist = withoutContact(shortlist, r.contact)
+				continue
+			}
+			for _, provider := range r.response.Providers {
+				if provider.GID != "" && provider.Addr != "" && !containsContact(providers, provider) {
+					providers = append(providers, provider)
+				}
+			}
+			for _, contact := range r.response.Contacts {
+				if contact.GID != "" && contact.Addr != "" && !containsContact(shortlist, contact) {
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+
+		sortByDistance(target, shortlist)
+		if len(shortlist) > dhtK {
+			shortlist = shortlist[:dhtK]
+		}
+	}
+
+	return withoutContact(shortlist, myContact()), providers
+}
+
+func containsContact(contacts []Contact, contact Contact) bool {
+	for _, c := range contacts {
+		if c.GID == contact.GID {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutContact(contacts []Contact, contact Contact) []Contact {
+	kept := make([]Contact, 0, len(contacts))
+	for _, c := range contacts {
+		if c.GID != contact.GID {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// finds how to reach a node by its GID
+func FindNode(gid string) (Contact, bool) {
+	for peer := range Peers {
+		if peer.Meta.GID == gid {
+			return contactForPeer(peer), true
+		}
+	}
+
+	closest, _ := lookup(hashID(gid), "")
+	for _, contact := range closest {
+		if contact.GID == gid {
+			return contact, true
+		}
+	}
+	return Contact{}, false
+}
+
+// records us as a provider of key (eg. a room topic) on the nodes closest to it
+// the record is re-stored every republishInterval until the program exits, or StopProviding
+func Provide(key string) {
+	providedLock.Lock()
+	provided[key] = true
+	providedLock.Unlock()
+
+	select {
+	case <-ready:
+		provide(key)
+	default: // we will provide it once we join the network
+	}
+}
+
+// stops re-storing our record for key, the ones already stored expire on their own
+func StopProviding(key string) {
+	providedLock.Lock()
+	delete(provided, key)
+	providedLock.Unlock()
+}
+
+func provide(key string) {
+	closest, _ := lookup(hashID(key), "")
+	storeProvider(key, myContact()) // so a lookup that reaches us finds us too
+
+	for _, contact := range closest {
+		dhtExchange(contact.Addr, Packet{
+			Type:      STORE_VALUE,
+			Origin:    localAddress,
+			Payload:   DhtRequest{Sender: myContact(), Key: key},
+			Timestamp: time.Now().String(),
+		}, false)
+	}
+}
+
+// everyone who provides key, as far as the network knows
+func FindProviders(key string) []Contact {
+	_, found := lookup(hashID(key), key)
+	for _, provider := range lookupProviders(key) {
+		if !containsContact(found, provider) {
+			found = append(found, provider)
+		}
+	}
+	return withoutContact(found, myContact())
+}
+
+// sends a packet straight to one node, over our peer connection if we have one, otherwise found through the DHT
+func SendDirect(gid string, payload interface{}) bool {
+	directPacket := Packet{
+		Type:        DIRECT,
+		Origin:      localAddress,
+		Destination: gid,
+		Payload:     payload,
+		Timestamp:   time.Now().String(),
+	}
+
+	for peer := range Peers {
+		if peer.Meta.GID == gid {
+			queuePacket(peer, directPacket)
+			return true
+		}
+	}
+
+	contact, ok := FindNode(gid)
+	if !ok {
+		log("could not find " + gid + " in the DHT")
+		return false
+	}
+	_, ok = dhtExchange(contact.Addr, directPacket, false)
+	return ok
+}
+
+// fills our routing table by looking ourselves up and re-stores what we provide, at most every 30s
+func refreshDht() {
+	providedLock.Lock()
+	if time.Since(lastRefresh) < 30*time.Second {
+		providedLock.Unlock()
+		return
+	}
+	lastRefresh = time.Now()
+	keys := make([]string, 0, len(provided))
+	for key := range provided {
+		keys = append(keys, key)
+	}
+	providedLock.Unlock()
+
+	lookup(hashID(GID), "")
+	for _, key := range keys {
+		provide(key)
+	}
+}
+
+func republishLoop() {
+	for {
+		time.Sleep(republishInterval)
+		refreshDht()
+	}
+}
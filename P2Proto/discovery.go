@@ -0,0 +1,135 @@
+package P2Proto
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// LAN discovery, nodes announce themselves on a UDP multicast group so nobody has to type an address.
+// only over IPv4 on the default interface, an IPv6 group would hand us link local addresses that mean nothing to
+// anyone else, and nodes on one LAN nearly always share IPv4 anyway. set before calling Setup
+var DiscoveryEnabled = true
+var DiscoveryGroup = "239.255.42.99:9876"
+
+var discoveryInterval = 5 * time.Second
+
+// dont try to enter the network through the same discovered address more often than this
+var discoveryRetryInterval = 30 * time.Second
+
+const discoveryMagic = "P2PChat"
+
+type discoveryAnnouncement struct {
+	Magic           string
+	GID             string
+	Port            string
+	ConnectionCount int
+}
+
+func startDiscovery() {
+	group, err := net.ResolveUDPAddr("udp4", DiscoveryGroup)
+	if err != nil {
+		log("discovery disabled: " + err.Error())
+		return
+	}
+
+	listener, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log("discovery disabled: " + err.Error())
+		return
+	}
+	sender, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		listener.Close()
+		log("discovery disabled: " + err.Error())
+		return
+	}
+
+	log("announcing ourselves on " + DiscoveryGroup)
+	go listenForAnnouncements(listener, GID, discovered)
+	go sendAnnouncements(sender, ourAnnouncement)
+}
+
+func ourAnnouncement() discoveryAnnouncement {
+	_, port, _ := net.SplitHostPort(localAddress)
+	return discoveryAnnouncement{
+		Magic:           discoveryMagic,
+		GID:             GID,
+		Port:            port,
+		ConnectionCount: len(Peers),
+	}
+}
+
+func sendAnnouncements(sender *net.UDPConn, announce func() discoveryAnnouncement) {
+	for {
+		announcement, err := json.Marshal(announce())
+		if err != nil {
+			log(err.Error())
+			return
+		}
+
+		_, err = sender.Write(announcement)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log("discovery: " + err.Error())
+		}
+		time.Sleep(discoveryInterval)
+	}
+}
+
+// how long to wait after a failed read before trying again, doubling up to discoveryInterval
+var discoveryErrorDelay = 100 * time.Millisecond
+
+// passes every valid announcement not from self to found, along with the address they listen on
+func listenForAnnouncements(listener *net.UDPConn, self string, found func(discoveryAnnouncement, string)) {
+	buffer := make([]byte, 1024)
+	delay := discoveryErrorDelay
+
+	for {
+		n, source, err := listener.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil { // dont spin on an error that keeps coming back
+			log("discovery: " + err.Error())
+			time.Sleep(delay)
+			if delay *= 2; delay > discoveryInterval {
+				delay = discoveryInterval
+			}
+			continue
+		}
+		delay = discoveryErrorDelay
+
+		announcement := discoveryAnnouncement{}
+		err = json.Unmarshal(buffer[:n], &announcement)
+		if err != nil || announcement.Magic != discoveryMagic || announcement.GID == self {
+			continue // not for us, or our own announcement
+		}
+		if _, err := strconv.ParseUint(announcement.Port, 10, 16); err != nil {
+			continue
+		}
+
+		found(announcement, net.JoinHostPort(source.IP.String(), announcement.Port))
+	}
+}
+
+var discoveryTried = make(map[string]time.Time) // only used by the one listenForAnnouncements
+
+func discovered(announcement discoveryAnnouncement, addr string) {
+	addressesHeard([]string{addr})
+
+	// only nodes outside the network need to act on it. if neither of us is in one, let the lower GID dial
+	// so we dont both send a CONN_REQ to each other
+	if len(Peers) > 0 || (announcement.ConnectionCount == 0 && GID > announcement.GID) {
+		return
+	}
+	if time.Since(discoveryTried[addr]) < discoveryRetryInterval {
+		return
+	}
+	discoveryTried[addr] = time.Now()
+
+	log("discovered " + announcement.GID + " at " + addr + ", entering network")
+	go EnterNetwork(addr)
+}
@@ -0,0 +1,101 @@
+package P2Proto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testAnnouncer struct {
+	gid      string
+	port     string
+	listener *net.UDPConn
+	found    chan string // GIDs it heard from
+}
+
+func newTestAnnouncer(t *testing.T, gid string, port string) *testAnnouncer {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testAnnouncer{gid: gid, port: port, listener: listener, found: make(chan string, 16)}
+	listening := make(chan bool)
+	go func() {
+		listenForAnnouncements(listener, gid, func(announcement discoveryAnnouncement, addr string) {
+			if addr != "127.0.0.1:"+announcement.Port {
+				t.Errorf("%s heard %s at %s", gid, announcement.GID, addr)
+			}
+			select {
+			case a.found <- announcement.GID:
+			default:
+			}
+		})
+		close(listening)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-listening
+	})
+	return a
+}
+
+// announces a to the other's listener, standing in for the multicast group
+func (a *testAnnouncer) announceTo(t *testing.T, other *testAnnouncer) {
+	sender, err := net.DialUDP("udp4", nil, other.listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sending := make(chan bool)
+	go func() {
+		sendAnnouncements(sender, func() discoveryAnnouncement {
+			return discoveryAnnouncement{Magic: discoveryMagic, GID: a.gid, Port: a.port}
+		})
+		close(sending)
+	}()
+	t.Cleanup(func() {
+		sender.Close()
+		<-sending
+	})
+}
+
+func TestDiscoveryOnLoopback(t *testing.T) {
+	a := newTestAnnouncer(t, "a", "1111")
+	b := newTestAnnouncer(t, "b", "2222")
+	a.announceTo(t, b)
+	b.announceTo(t, a)
+	a.announceTo(t, a) // our own announcements come back to us over multicast too
+
+	for _, check := range []struct {
+		announcer *testAnnouncer
+		want      string
+	}{{a, "b"}, {b, "a"}} {
+		select {
+		case gid := <-check.announcer.found:
+			if gid != check.want {
+				t.Errorf("%s discovered %s, expected %s", check.announcer.gid, gid, check.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s never discovered %s", check.announcer.gid, check.want)
+		}
+	}
+}
+
+func TestDiscoveryStopsWhenClosed(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		listenForAnnouncements(listener, "a", func(discoveryAnnouncement, string) {})
+		close(done)
+	}()
+	listener.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("still listening after the socket closed")
+	}
+}
@@ -0,0 +1,187 @@
+package P2Proto
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// two nodes behind NATs that only reach each other through a relay can often still connect directly. if both dial
+// the address the other was seen at by the relay at the same moment, each NAT takes the other's incoming SYN as part
+// of the connection its own node is opening. the relayed link carries the coordination:
+//
+//	A -> B  CONNECT_VIA{Addrs: A's}   A dialed the circuit, and times how long the answer takes
+//	B -> A  CONNECT_VIA{Addrs: B's}
+//	A -> B  CONNECT_VIA{Sync: true}   then A waits half the round trip and B starts as soon as it arrives
+//
+// both then dial each other from the port they listen on until one gets through, and the relayed link is dropped
+// as a duplicate of the direct one. if none get through we stay on the relay. TCP only gets through NATs that take
+// a SYN from outside as part of an open, so when both sides listen for QUIC they also punch over UDP from the QUIC
+// socket at the same addresses, which works behind most NATs that keep the port. whichever gets through first wins
+
+// set before calling Setup, if we try to replace relayed links with direct ones
+var HolePunching = true
+
+var punchDuration = 5 * time.Second
+var punchDialTimeout = 200 * time.Millisecond // short, we keep trying each address until punchDuration is up
+var maxPunchAddrs = 8
+
+// the TCP port we listen on, hole punching dials out from it too
+var listenPort int
+
+type ConnectVia struct {
+	Addrs []string `wire:"1"` // where the sender can be reached, observed addresses first
+	Sync  bool     `wire:"2"` // start dialing now
+}
+
+func init() {
+	RegisterPayload(14, ConnectVia{})
+}
+
+func connectViaPacket(via ConnectVia) Packet {
+	return Packet{
+		Type:      CONNECT_VIA,
+		Origin:    localAddress,
+		Payload:   via,
+		Timestamp: time.Now().String(),
+	}
+}
+
+// called by handlePeer, starts coordinating if we reached peer through a relay
+func startHolePunch(peer *Peer) {
+	if !HolePunching || !peer.dialed || !peer.isRelayed() || !peer.supports(FEATURE_HOLEPUNCH) {
+		return
+	}
+	peer.punchStarted = time.Now()
+	sendToPeer(peer, connectViaPacket(ConnectVia{Addrs: ourAddresses()}))
+}
+
+// only ever called from the peer's handlePeer, so the punch fields need no lock
+func recieveConnectVia(packet Packet, from *Peer) {
+	via, ok := packet.Payload.(ConnectVia)
+	if !ok || !HolePunching || !from.isRelayed() {
+		return
+	}
+	addrs := via.Addrs
+	if len(addrs) > maxPunchAddrs {
+		addrs = addrs[:maxPunchAddrs]
+	}
+
+	if via.Sync { // we answered them, go
+		if from.punchAddrs != nil {
+			go punch(from, from.punchAddrs)
+			from.punchAddrs = nil
+		}
+	} else if from.dialed { // the answer to ours
+		if from.punchStarted.IsZero() {
+			return
+		}
+		rtt := time.Since(from.punchStarted)
+		from.punchStarted = time.Time{}
+		sendToPeer(from, connectViaPacket(ConnectVia{Sync: true}))
+		go func() {
+			time.Sleep(rtt / 2) // about when the sync reaches them
+			punch(from, addrs)
+		}()
+	} else {
+		from.punchAddrs = addrs
+		sendToPeer(from, connectViaPacket(ConnectVia{Addrs: ourAddresses()}))
+	}
+}
+
+type punchedConn struct {
+	conn net.Conn // nil if nothing got through
+	addr string
+	over string
+}
+
+// dials addrs until one gets through or they get through to us, the direct link then replaces the relayed one
+func punch(peer *Peer, addrs []string) {
+	gid := peer.Meta.GID
+	log("punching through to " + gid + " at " + strings.Join(addrs, ", "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), punchDuration)
+	defer cancel()
+	punched := make(chan punchedConn)
+	attempts := 0
+	for _, addr := range addrs {
+		if isOwnAddress(addr) {
+			continue
+		}
+		attempts++
+		go punchTCP(ctx, gid, addr, punched)
+		if peer.supports(FEATURE_QUIC) && quicListening {
+			attempts++
+			go punchQUIC(ctx, addr, punched)
+		}
+	}
+
+	for ; attempts > 0; attempts-- {
+		result := <-punched
+		if result.conn == nil {
+			continue
+		}
+		cancel()
+		go func(remaining int) { // the rest give up now, close any that got through anyway
+			for ; remaining > 0; remaining-- {
+				if late := <-punched; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}(attempts - 1)
+
+		log("punched through to " + gid + " at " + result.addr + " over " + result.over)
+		sendAck(result.conn, result.addr)
+		go handlePeer(&Peer{Connection: result.conn, Features: peer.Features, dialed: true})
+		return
+	}
+	if !connectedDirectly(gid) {
+		log("could not punch through to " + gid + ", staying on the relay")
+	}
+}
+
+// keeps opening a TCP connection to addr until one gets through, ctx is done, or they got through to us
+func punchTCP(ctx context.Context, gid string, addr string, punched chan punchedConn) {
+	for ctx.Err() == nil && !connectedDirectly(gid) {
+		conn, err := dialFromListenPort(addr, punchDialTimeout)
+		if err == nil {
+			punched <- punchedConn{conn: conn, addr: addr, over: "tcp"}
+			return
+		}
+		select { // refused rather than timed out, dont spin
+		case <-time.After(punchDialTimeout):
+		case <-ctx.Done():
+		}
+	}
+	punched <- punchedConn{}
+}
+
+// one QUIC dial is enough, it keeps resending until the other side answers or ctx is done
+func punchQUIC(ctx context.Context, addr string, punched chan punchedConn) {
+	conn, err := quicTransport.(*quicTransportImpl).dialFromListenSocket(ctx, addr)
+	if err != nil {
+		punched <- punchedConn{}
+		return
+	}
+	punched <- punchedConn{conn: conn, addr: addr, over: "quic"}
+}
+
+func connectedDirectly(gid string) bool {
+	for peer := range Peers {
+		if peer.Meta.GID == gid && !peer.isRelayed() {
+			return true
+		}
+	}
+	return false
+}
+
+// dials from the port we listen on, so a NAT maps it the same as the connections others saw us at
+func dialFromListenPort(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if canReusePort && listenPort != 0 {
+		dialer.LocalAddr = &net.TCPAddr{Port: listenPort}
+		dialer.Control = reusePort
+	}
+	return dialer.Dial("tcp", addr)
+}
@@ -0,0 +1,42 @@
+package P2Proto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where our node ID is kept between runs, set before calling Setup
+var IdentityPath = "identity"
+
+// stays the same across runs and addresses, used as our GID
+var NodeID string
+
+// reads our node ID, making a new random one on the first run
+func loadIdentity() string {
+	encoded, err := os.ReadFile(IdentityPath)
+	if err == nil {
+		id := strings.TrimSpace(string(encoded))
+		if _, ok := parseID(id); ok {
+			return id
+		}
+		log("invalid identity in " + IdentityPath + ", making a new one")
+	}
+
+	id := nodeID{}
+	_, err = rand.Read(id[:])
+	if err != nil {
+		panic(err.Error())
+	}
+
+	err = os.MkdirAll(filepath.Dir(IdentityPath), 0700)
+	if err == nil {
+		err = os.WriteFile(IdentityPath, []byte(hex.EncodeToString(id[:])+"\n"), 0600)
+	}
+	if err != nil {
+		log("could not save identity: " + err.Error())
+	}
+	return id.String()
+}
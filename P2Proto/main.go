@@ -1,40 +1,85 @@
 package P2Proto
 
 import (
+	"bufio"
 	"net"
-	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
 type PeerMeta struct {
-	ConnectionCount int
-	GID             string
+	ConnectionCount int    `wire:"1"`
+	GID             string `wire:"2"`
+	ListenAddr      string `wire:"3"` // where they accept connections, not the address a connection came from
+}
+
+// nodes from before protocol version 2 used the address they listen on as their GID
+func (meta PeerMeta) listenAddress() string {
+	if meta.ListenAddr != "" {
+		return meta.ListenAddr
+	}
+	return meta.GID
 }
 
 type Peer struct {
 	Connection net.Conn
 	Meta       PeerMeta
+	Features   Feature // what both of us support, agreed in the handshake
+
+	reader  *bufio.Reader // buffers Connection, may hold the start of the next carrier
+	limiter peerLimiter
+	queue   *sendQueue      // nil until handlePeer starts its writer
+	sent    map[string]bool // IDs of packets this peer sent us recently
+
+	dialed bool // we opened the connection, rather than them
+
+	bulk       bulkWriter // only used by the writer, nil until there is bulk to send over a bulkConn
+	bulkFailed bool
+
+	punchStarted time.Time // when we sent our CONNECT_VIA, see holePunch.go
+	punchAddrs   []string  // theirs, until they tell us to start
 }
 
 type PeerList map[*Peer]bool
 
-var Peers PeerList
-var recentPackets []Packet
+// made here rather than in Setup, so Subscribe can be used before it runs
+var Peers = make(PeerList)
 var localAddress string
 
-var addPeerChan chan *Peer
-var removePeerChan chan *Peer
+// closed once Setup knows our address and ID
+var ready = make(chan bool)
+
+var addPeerChan chan peerCheck
+var removePeerChan chan *Peer // nil from Ban asks to drop banned peers
 
 var waitPeers sync.WaitGroup
 
+// our node ID, the same as NodeID
 var GID string
 
+// set before calling Setup, host:port, the host can be left out to listen on every interface over both IPv4 and IPv6.
+// IPv6 hosts go in brackets, eg. [::1]:1234
+var ListenAddress = ":1234"
+var BootstrapAddrs []string
+
 // fuunctions to update outside library
 var log func(string)
 var alertPacket func(Packet)
 var alertPeers func(PeerList)
 
+// set before calling Setup to get connects, disconnects, bans and errors with their details kept apart as key value
+// pairs, eg. "peer", GID, "addr", address, for logs read by programs. they go to the log func otherwise
+var LogEvent func(event string, message string, attrs ...string)
+
+func logEvent(event string, message string, attrs ...string) {
+	if LogEvent != nil {
+		LogEvent(event, message, attrs...)
+		return
+	}
+	log(message)
+}
+
 // blocks, should be called as a go routine
 func Setup(p func(Packet), u func(PeerList), l func(string)) {
 	// init channels and other vars
@@ -42,12 +87,9 @@ func Setup(p func(Packet), u func(PeerList), l func(string)) {
 	alertPacket = p
 	alertPeers = u
 
-	addPeerChan = make(chan *Peer)
+	addPeerChan = make(chan peerCheck)
 	removePeerChan = make(chan *Peer)
 
-	Peers = make(map[*Peer]bool)
-	recentPackets = make([]Packet, 0)
-
 	// init server and get local addr
 	server, err := initServer()
 	if err != nil {
@@ -56,37 +98,91 @@ func Setup(p func(Packet), u func(PeerList), l func(string)) {
 	}
 	defer server.Close()
 
-	// have to connect to self to get addr
-	c, err := net.Dial("tcp4", server.Addr().String())
-	localAddress = c.RemoteAddr().String()
-	c.Close()
-	log("Listening on: " + localAddress)
+	ourAddrsLock.Lock()
+	interfaceAddrs = findInterfaceAddresses(server)
+	ourAddrsLock.Unlock()
+	localAddress = ourAddresses()[0]
+	listenPort = server.Addr().(*net.TCPAddr).Port
+	log("Listening on: " + server.Addr().String() + ", reachable at " + strings.Join(ourAddresses(), ", "))
+
+	NodeID = loadIdentity()
+	GID = NodeID
+	log("Node ID: " + NodeID)
+	close(ready)
+
+	if SimulateNat {
+		log("simulating a NAT, no longer listening")
+		server.Close()
+	} else {
+		go listenForConnections(server)
+	}
+	if QuicEnabled && !SimulateNat {
+		quicServer, err := quicTransport.Listen(server.Addr().String())
+		if err != nil {
+			log("not listening for QUIC: " + err.Error())
+		} else {
+			defer quicServer.Close()
+			quicListening = true
+			supportedFeatures |= FEATURE_QUIC
+			log("Listening for QUIC on: " + quicServer.Addr().String())
+			go listenForConnections(quicServer)
+		}
+	}
+	if HolePunching {
+		supportedFeatures |= FEATURE_HOLEPUNCH
+	}
+	log("\n")
 
-	GID = localAddress
+	if DiscoveryEnabled {
+		startDiscovery()
+	}
+	go republishLoop()
+	go heartbeatLoop()
+	go pruneOriginsLoop()
+	go forgetPacketsLoop()
+
+	if RelayAddr != "" { // others need to be able to reach us through it before we ask to join
+		reserved := make(chan bool)
+		go keepRelayReservation(reserved)
+		select {
+		case <-reserved:
+		case <-time.After(tmpConnTimeout):
+		}
+	}
 
-	go listenForConnections(server)
-	log("\n")
+	// reconnect to whoever we knew last time before falling back to configured bootstrap peers, but only the most
+	// promising few so a book full of dead addresses cant hold up the configured ones
+	known := KnownAddresses()
+	if len(known) > maxKnownBootstrap {
+		known = known[:maxKnownBootstrap]
+	}
+	go Bootstrap(append(known, BootstrapAddrs...))
 
 	// was using for loop, but eats up CPU
 	for {
 		select {
-		case newPeer := <-addPeerChan:
-			Peers[newPeer] = true
-
-			alertPeers(Peers)
-			waitPeers.Done()
+		case check := <-addPeerChan:
+			kept := keepConnection(check.peer)
+			if kept {
+				Peers[check.peer] = true
+				alertPeers(Peers)
+			}
+			check.kept <- kept
 		case oldPeer := <-removePeerChan:
+			if oldPeer == nil { // from Ban
+				dropBannedPeers()
+				continue
+			}
+
 			_, ok := Peers[oldPeer]
 			if ok {
 				delete(Peers, oldPeer)
+				pubsubPeerRemoved(oldPeer)
 
-				log("disconnected, sending out new CONN_REQ")
-				connReq := Packet{
-					Type:      CONN_REQ,
-					Origin:    localAddress,
-					Timestamp: time.Now().String(),
+				if !connectedToNode(oldPeer.Meta.GID) { // it may have been a duplicate connection, dropped by either side
+					log("disconnected, sending out new CONN_REQ")
+					recieveConnectionRequest(newConnReq())
 				}
-				recieveConnectionRequest(connReq)
 			}
 
 			alertPeers(Peers)
@@ -97,19 +193,13 @@ func Setup(p func(Packet), u func(PeerList), l func(string)) {
 
 func initServer() (net.Listener, error) {
 	log("Initing server...")
-	arguments := os.Args
-	PORT := ":1234"
-
-	if len(arguments) > 1 {
-		PORT = ":" + arguments[1]
-	}
-
-	return net.Listen("tcp4", PORT)
+	return tcpTransport.Listen(ListenAddress)
 }
 
 func getMyMeta() PeerMeta {
 	return PeerMeta{
 		ConnectionCount: len(Peers),
 		GID:             GID,
+		ListenAddr:      localAddress,
 	}
 }
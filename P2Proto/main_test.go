@@ -0,0 +1,25 @@
+package P2Proto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// package settings are set once here, goroutines left by one test could otherwise see the next one change them
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "p2proto-test")
+	if err != nil {
+		panic(err)
+	}
+
+	log = func(string) {}
+	BanListPath = filepath.Join(dir, "bans.json")
+	RelayService = true
+	discoveryInterval = 50 * time.Millisecond
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,63 @@
+package P2Proto
+
+import (
+	"time"
+)
+
+// peer exchange, shares addresses we have successfully connected to
+type Pex struct {
+	Addrs []string `wire:"1"`
+}
+
+// most addresses we send or accept in one PEX
+var maxPexAddrs = 64
+
+func init() {
+	RegisterPayload(6, Pex{})
+}
+
+// sent straight to a new peer, never passed on
+func sendPex(peer *Peer) {
+	addrs := ourAddresses()
+	for other := range Peers {
+		if other != peer && other.Meta.listenAddress() != "" {
+			addrs = append(addrs, other.Meta.listenAddress())
+		}
+	}
+	addrs = append(addrs, goodAddresses()...)
+
+	// remove duplicates and the peer itself
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !seen[addr] && addr != peer.Meta.listenAddress() {
+			seen[addr] = true
+			unique = append(unique, addr)
+		}
+	}
+	if len(unique) > maxPexAddrs {
+		unique = unique[:maxPexAddrs]
+	}
+
+	pexPacket := Packet{
+		Type:      PEX,
+		Origin:    localAddress,
+		Payload:   Pex{Addrs: unique},
+		Timestamp: time.Now().String(),
+	}
+	sendToPeer(peer, pexPacket)
+}
+
+func recievePex(packet Packet) {
+	pex, ok := packet.Payload.(Pex)
+	if !ok {
+		log("invalid PEX from " + packet.Origin)
+		return
+	}
+
+	addrs := pex.Addrs
+	if len(addrs) > maxPexAddrs {
+		addrs = addrs[:maxPexAddrs]
+	}
+	addressesHeard(addrs)
+}
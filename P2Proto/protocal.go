@@ -1,14 +1,21 @@
 package P2Proto
 
 import (
-	"encoding/gob"
+	"bufio"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 var MIN_DESIRED_PEERS = 2
 
+// when we saw or sent each packet, by packetID, so a flood reaching us several ways is only handled once
+var recentPacketsLock sync.Mutex
+var recentPackets = make(map[string]time.Time)
+var recentPacketTTL = 10 * time.Minute
+var maxRecentPackets = 100000
+
 type PacketType byte
 
 const (
@@ -16,54 +23,138 @@ const (
 	CONN_REQ
 	CONN_ACK
 	BLANK // used to just send meta data, packet is empty
+	WANT
+	HAVE
+	BLOB
+	PEX
+	FIND_NODE
+	FIND_VALUE
+	STORE_VALUE
+	NODES  // reply to FIND_NODE and FIND_VALUE
+	DIRECT // for a single node, see Destination
+	SUBSCRIBE
+	PUBLISH // for everyone subscribed to Topic
+	GRAFT
+	PRUNE
+	IHAVE
+	IWANT
+	CONN_REJECT
+	RELAY_RESERVE // see relay.go
+	RELAY_CONNECT
+	CONNECT_VIA // see holePunch.go
 )
 
 type Packet struct {
-	Type      PacketType
-	Origin    string
-	Payload   interface{} // arbitrary data type
-	Timestamp string
+	Type        PacketType  `wire:"1"`
+	Origin      string      `wire:"2"`
+	Destination string      `wire:"3"` // GID, only used by DIRECT
+	Topic       string      `wire:"4"` // only used by PUBLISH
+	Payload     interface{} `wire:"5"` // arbitrary data type
+	Timestamp   string      `wire:"6"`
 }
 
 type Carrier struct {
-	Packet Packet
-	Meta   PeerMeta
+	Packet Packet   `wire:"1"`
+	Meta   PeerMeta `wire:"2"`
 }
 
 // asynchronous function, a different instance is run for each peer
 func handlePeer(peer *Peer) {
+	if isBanned(peer.Meta.GID) || isBanned(peer.Connection.RemoteAddr().String()) {
+		log("refusing banned " + peer.Connection.RemoteAddr().String() + "(" + peer.Meta.GID + ")")
+		peer.Connection.Close()
+		return
+	}
+	peer.startWriter()
+	if !addPeer(peer) {
+		peer.stopWriter()
+		peer.Connection.Close()
+		return
+	}
 
-	waitPeers.Add(1)
-	addPeerChan <- peer
-	waitPeers.Wait()
-
-	log("added connection " + peer.Connection.RemoteAddr().String() + "(" + peer.Meta.GID + ")" + " to peers")
+	logEvent("connect", "added connection "+peer.Connection.RemoteAddr().String()+"("+peer.Meta.GID+")"+" to peers",
+		"peer", peer.Meta.GID, "addr", peer.Connection.RemoteAddr().String())
 
 	announceBlank() // to update our neighbors of our new peer count
+	sendHaves(peer)
+	sendSubscriptions(peer)
+	if peer.Meta.GID != "" {
+		addressSeen(peer.Meta.listenAddress())
+		sendPex(peer)
+		if peer.supports(FEATURE_DHT) {
+			addContact(contactForPeer(peer))
+			go refreshDht()
+		}
+	}
+	startHolePunch(peer)
 
 	// dont return in this loop, have some cleaning up to do afterward
+	if peer.reader == nil {
+		peer.reader = bufio.NewReader(peer.Connection)
+	}
+	incoming := make(chan recievedCarrier)
+	doneReading := make(chan bool)
+	go readLoop(peer.reader, incoming, doneReading)
+	go readBulkLoop(peer, incoming, doneReading)
+
 	for {
-		dec := gob.NewDecoder(peer.Connection)
-		carrier := &Carrier{}
-		err := dec.Decode(carrier) // blocking till we finish reading message
+		recieved := <-incoming // blocking till we finish reading a message from any stream
+		carrier, size, err := &recieved.carrier, recieved.size, recieved.err
 
 		if err == io.EOF { // client disconnected
 			break
-		} else if err != nil { // error decoding message
-			log(err.Error())
+		} else if err != nil { // error decoding message, we cant find where the next one starts so give up on them
+			logEvent("error", "dropping "+peer.Connection.RemoteAddr().String()+", could not read: "+err.Error(),
+				"peer", peer.Meta.GID, "addr", peer.Connection.RemoteAddr().String(), "error", err.Error())
+			if _, isNetError := err.(net.Error); !isNetError && err != io.ErrUnexpectedEOF {
+				penalizePeer(peer, offenseDecode) // not just a broken connection
+			}
+			break
+		}
+
+		allowed, disconnect := peer.allowPacket(carrier.Packet, size)
+		if disconnect {
+			log("dropping " + peer.Connection.RemoteAddr().String() + "(" + peer.Meta.GID + "), too many packets over the rate limit")
+			break
+		} else if !allowed {
+			continue
+		}
+		if peer.repeated(carrier.Packet) {
+			penalizePeer(peer, offenseDuplicate)
 			continue
 		}
 
 		// no errors, handle packet
 		// first update meta about peer
+		knownGID := peer.Meta.GID
 		peer.Meta = carrier.Meta
 		alertPeers(Peers)
+		if isBanned(peer.Meta.GID) {
+			log("dropping banned " + peer.Meta.GID)
+			break
+		}
 
-		recievePacket(carrier.Packet)
+		if knownGID == "" && peer.Meta.GID != "" { // the side that accepted us only learns who we are now
+			if !addPeer(peer) {
+				break
+			}
+			addressSeen(peer.Meta.listenAddress())
+			sendPex(peer)
+			if peer.supports(FEATURE_DHT) {
+				addContact(contactForPeer(peer))
+				go refreshDht()
+			}
+		}
+
+		recievePacket(carrier.Packet, peer)
 	}
 
-	log("stopped handling peer " + peer.Connection.RemoteAddr().String() + "(" + peer.Meta.GID + ")\n")
+	logEvent("disconnect", "stopped handling peer "+peer.Connection.RemoteAddr().String()+"("+peer.Meta.GID+")\n",
+		"peer", peer.Meta.GID, "addr", peer.Connection.RemoteAddr().String())
+	close(doneReading)
 	peer.Connection.Close()
+	peer.stopWriter()
+	addressSeen(peer.Meta.listenAddress())
 
 	waitPeers.Add(1)
 	removePeerChan <- peer // update the peer list
@@ -72,15 +163,85 @@ func handlePeer(peer *Peer) {
 	announceBlank() // to update our neighbors of our new peer count
 }
 
-func recievePacket(packet Packet) {
-	// check we havent seen this packet before (may not always be a good idea, probably have to change later)
-	for _, oldPacket := range recentPackets {
-		if oldPacket.Timestamp == packet.Timestamp { // should probably have better way of checking this
-			return
+// asks the Setup loop to add peer to Peers, or to check it again once we know who it is. keepConnection runs there
+// too, so two connections to the same node cant both be checked before either is added
+type peerCheck struct {
+	peer *Peer
+	kept chan bool
+}
+
+// false if peer is a duplicate connection to drop
+func addPeer(peer *Peer) bool {
+	kept := make(chan bool)
+	addPeerChan <- peerCheck{peer: peer, kept: kept}
+	return <-kept
+}
+
+// only called from the Setup loop. when two nodes dial each other at the same time they end up connected twice. both sides keep the
+// connection dialed by the node with the lower GID, so they agree without having to ask each other.
+// returns false if peer is the one to drop, otherwise closes the other connection if there is one
+func keepConnection(peer *Peer) bool {
+	if peer.Meta.GID == "" { // dont know who they are yet
+		return true
+	}
+	if peer.Meta.GID == GID {
+		log("dropping " + peer.Connection.RemoteAddr().String() + ", it is a connection to ourselves")
+		return false
+	}
+
+	for other := range Peers {
+		if other == peer || other.Meta.GID != peer.Meta.GID {
+			continue
 		}
+		if other.isRelayed() != peer.isRelayed() { // a direct connection beats one through a relay, whoever dialed
+			if peer.isRelayed() {
+				log("already connected directly to " + peer.Meta.GID + ", dropping relayed " + peer.Connection.RemoteAddr().String())
+				return false
+			}
+			log("connected directly to " + peer.Meta.GID + ", dropping relayed " + other.Connection.RemoteAddr().String())
+			other.Connection.Close()
+			continue
+		}
+		if dialer(other) == dialer(peer) || dialer(other) < dialer(peer) { // keep the one we already have if its a tie
+			log("already connected to " + peer.Meta.GID + ", dropping " + peer.Connection.RemoteAddr().String())
+			return false
+		}
+		log("already connected to " + peer.Meta.GID + ", dropping " + other.Connection.RemoteAddr().String())
+		other.Connection.Close()
+	}
+	return true
+}
+
+func connectedToNode(gid string) bool {
+	for peer := range Peers {
+		if gid != "" && peer.Meta.GID == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// GID of the node that opened the connection
+func dialer(peer *Peer) string {
+	if peer.dialed {
+		return GID
+	}
+	return peer.Meta.GID
+}
+
+// from is the peer the packet arrived over
+func recievePacket(packet Packet, from *Peer) {
+	// check we havent seen this packet before (may not always be a good idea, probably have to change later)
+	if seenPacket(packet) {
+		return
 	}
 	// then add it so we dont handle again
-	recentPackets = append(recentPackets, packet)
+	rememberPacket(packet)
+
+	if packet.Type == DIRECT && packet.Destination != GID {
+		log("dropping DIRECT meant for " + packet.Destination)
+		return
+	}
 
 	// make new packet available to handle outside of library
 	alertPacket(packet)
@@ -89,7 +250,30 @@ func recievePacket(packet Packet) {
 	case MESSAGE:
 		recieveMessage(packet)
 	case CONN_REQ:
+		if from != nil {
+			packet = addCandidate(packet, observedFrom(from.Connection, packet.Origin), from.Meta.GID)
+		}
 		recieveConnectionRequest(packet)
+	case WANT:
+		recieveWant(packet, from)
+	case HAVE:
+		recieveHave(packet, from)
+	case BLOB:
+		recieveBlob(packet, from)
+	case PEX:
+		recievePex(packet)
+	case SUBSCRIBE:
+		recieveSubscription(packet, from)
+	case PUBLISH:
+		recievePublish(packet, from)
+	case GRAFT, PRUNE:
+		recieveTopicControl(packet, from)
+	case IHAVE:
+		recieveIHave(packet, from)
+	case IWANT:
+		recieveIWant(packet, from)
+	case CONNECT_VIA:
+		recieveConnectVia(packet, from)
 		// we ignore CONN_ACK since they only act as meta data updters, done in recievePacket func. use this oppertunity to check some stuff
 	}
 }
@@ -108,7 +292,7 @@ func recieveConnectionRequest(packet Packet) {
 	var peerToPassTo *Peer = nil
 	// get peer with lowest connection count
 	for peer := range Peers {
-		if peer.Meta.GID != packet.Origin { // dont pass to the node trying to connect
+		if peer.Meta.listenAddress() != packet.Origin { // dont pass to the node trying to connect
 			if peerToPassTo == nil || peer.Meta.ConnectionCount < peerToPassTo.Meta.ConnectionCount {
 				peerToPassTo = peer
 			}
@@ -123,39 +307,88 @@ func recieveConnectionRequest(packet Packet) {
 		}
 	}
 
-	if peerToPassTo == nil {
+	if isBanned(packet.Origin) {
+		log("ignoring connection request from banned " + packet.Origin)
+	} else if peerToPassTo == nil {
 		if packet.Origin == localAddress {
 			log("cannot request connection to self")
 		} else {
-			log("got connection request from " + packet.Origin + ", accepting")
-
-			conn, ok := requestConnection(packet.Origin)
-			if ok {
-				newPeer := Peer{
-					Connection: conn,
-				}
-				sendAck(conn) // let them know they are a peer now
-				go handlePeer(&newPeer)
+			features, compatible, reason := checkHandshake(packet)
+			if !compatible {
+				log("refusing connection request from " + packet.Origin + ", incompatible protocol: " + reason)
+			} else {
+				log("got connection request from " + packet.Origin + ", accepting")
 			}
+
+			// dialing can take a while, dont hold up the peer it came from
+			go acceptConnectionRequest(packet, features, compatible, reason)
 		}
 	} else {
 		log("got connection request from " + packet.Origin + ", forwarding to " + peerToPassTo.Connection.RemoteAddr().String())
-		sendPacket(peerToPassTo.Connection, packet)
+		queuePacket(peerToPassTo, packet)
+	}
+}
+
+// dials whoever sent a CONN_REQ at every address they gave, keeping the first that answers
+func acceptConnectionRequest(packet Packet, features Feature, compatible bool, reason string) {
+	candidates := candidateAddrs(packet)
+	for _, addr := range candidates {
+		if connectedTo(addr) {
+			log("already connected to " + packet.Origin + " at " + addr)
+			return
+		}
+	}
+
+	conn, reachedAt, ok := dialEach(candidates, peerTransport(features))
+	if handshake, _ := packet.Payload.(Handshake); !ok && handshake.Relay != "" && handshake.GID != "" {
+		// they are probably behind a NAT
+		conn, ok = requestRelayedConnection(handshake.Relay, handshake.GID)
+	}
+	if !ok {
+		return
+	}
+	if !compatible {
+		sendReject(conn, "incompatible protocol: "+reason) // let them know why
+		conn.Close()
+		return
 	}
+
+	newPeer := Peer{
+		Connection: conn,
+		Features:   features,
+		dialed:     true,
+	}
+	sendAck(conn, reachedAt) // let them know they are a peer now
+	handlePeer(&newPeer)
+}
+
+// tries each address in turn, returning the first connection made. one at a time, as the addresses come from
+// whoever asked us to connect
+func dialEach(addrs []string, transport Transport) (net.Conn, string, bool) {
+	for _, addr := range addrs {
+		conn, ok := requestConnection(addr, transport)
+		if !ok && transport != tcpTransport { // UDP may be blocked between us
+			conn, ok = requestConnection(addr, tcpTransport)
+		}
+		if ok {
+			return conn, addr, true
+		}
+	}
+	return nil, "", false
 }
 
 // sends packet to all peers
 func announcePacket(packet Packet) {
 	for peer := range Peers {
 		if peer.Connection.RemoteAddr().String() != packet.Origin {
-			sendPacket(peer.Connection, packet)
+			sendToPeer(peer, packet)
 		}
 	}
 }
 
-// sends packet to a peer
+// writes packet straight to a connection, peers go through queuePacket instead
 func sendPacket(connection net.Conn, packet Packet) {
-	recentPackets = append(recentPackets, packet)
+	rememberPacket(packet)
 
 	// wrap in carrier
 	carrier := Carrier{
@@ -163,11 +396,58 @@ func sendPacket(connection net.Conn, packet Packet) {
 		Meta:   getMyMeta(),
 	}
 
-	encoder := gob.NewEncoder(connection)
-	err := encoder.Encode(carrier) // writes to tcp connection
+	connection.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := writeCarrier(connection, carrier) // writes to tcp connection
 
 	if err != nil {
-		log(err.Error())
+		logEvent("error", err.Error(), "addr", connection.RemoteAddr().String(), "error", err.Error())
+	}
+}
+
+func rememberPacket(packet Packet) {
+	now := time.Now()
+	recentPacketsLock.Lock()
+	defer recentPacketsLock.Unlock()
+
+	if len(recentPackets) >= maxRecentPackets {
+		forgetPackets(now)
+	}
+	recentPackets[packetID(packet)] = now
+}
+
+// called holding recentPacketsLock. drops expired packets, and if that isnt enough some others, a flood big enough to
+// fill the map is better handled twice than left to grow it
+func forgetPackets(now time.Time) {
+	for id, seen := range recentPackets {
+		if now.Sub(seen) > recentPacketTTL {
+			delete(recentPackets, id)
+		}
+	}
+	for id := range recentPackets {
+		if len(recentPackets) < maxRecentPackets*9/10 {
+			break
+		}
+		delete(recentPackets, id)
+	}
+}
+
+func seenPacket(packet Packet) bool {
+	return seenPacketID(packetID(packet))
+}
+
+func seenPacketID(id string) bool {
+	recentPacketsLock.Lock()
+	defer recentPacketsLock.Unlock()
+	seen, ok := recentPackets[id]
+	return ok && time.Since(seen) <= recentPacketTTL
+}
+
+func forgetPacketsLoop() {
+	for {
+		time.Sleep(recentPacketTTL)
+		recentPacketsLock.Lock()
+		forgetPackets(time.Now())
+		recentPacketsLock.Unlock()
 	}
 }
 
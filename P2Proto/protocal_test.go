@@ -0,0 +1,57 @@
+package P2Proto
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func resetRecentPackets(t *testing.T, max int) {
+	oldMax := maxRecentPackets
+	maxRecentPackets = max
+	recentPacketsLock.Lock()
+	recentPackets = make(map[string]time.Time)
+	recentPacketsLock.Unlock()
+	t.Cleanup(func() {
+		maxRecentPackets = oldMax
+		recentPacketsLock.Lock()
+		recentPackets = make(map[string]time.Time)
+		recentPacketsLock.Unlock()
+	})
+}
+
+func TestRecentPacketsBounded(t *testing.T) {
+	resetRecentPackets(t, 100)
+
+	for i := 0; i < 1000; i++ {
+		rememberPacket(Packet{Origin: "a", Timestamp: strconv.Itoa(i)})
+	}
+	recentPacketsLock.Lock()
+	count := len(recentPackets)
+	recentPacketsLock.Unlock()
+	if count > 100 {
+		t.Fatalf("remembered %d packets, at most 100 allowed", count)
+	}
+	if !seenPacket(Packet{Origin: "a", Timestamp: "999"}) {
+		t.Fatalf("forgot the newest packet")
+	}
+}
+
+func TestRecentPacketsExpire(t *testing.T) {
+	resetRecentPackets(t, 100)
+
+	rememberPacket(Packet{Origin: "a", Timestamp: "old"})
+	if !seenPacketID(packetID(Packet{Origin: "a", Timestamp: "old"})) {
+		t.Fatalf("packet not remembered")
+	}
+	if seenPacket(Packet{Origin: "b", Timestamp: "old"}) {
+		t.Fatalf("same timestamp from another origin counted as seen")
+	}
+
+	recentPacketsLock.Lock()
+	recentPackets[packetID(Packet{Origin: "a", Timestamp: "old"})] = time.Now().Add(-2 * recentPacketTTL)
+	recentPacketsLock.Unlock()
+	if seenPacket(Packet{Origin: "a", Timestamp: "old"}) {
+		t.Fatalf("expired packet still counted as seen")
+	}
+}
@@ -0,0 +1,394 @@
+package P2Proto
+
+import (
+	"sync"
+	"time"
+)
+
+// GossipSub style pub/sub. subscribers of a topic keep a mesh of up to meshHigh peers that get every
+// message eagerly, other subscribed peers only hear the IDs (IHAVE) and ask for what they missed (IWANT).
+// nodes that arent subscribed pass messages on to their subscribed peers, or flood if they know none
+
+type Subscription struct {
+	Topics    []string `wire:"1"`
+	Subscribe bool     `wire:"2"` // false to unsubscribe
+}
+
+type TopicControl struct { // GRAFT and PRUNE
+	Topic string `wire:"1"`
+}
+
+type IHave struct {
+	Topic string   `wire:"1"`
+	IDs   []string `wire:"2"`
+}
+
+type IWant struct {
+	IDs []string `wire:"1"`
+}
+
+var meshLow = 2
+var meshTarget = 4
+var meshHigh = 8
+
+var heartbeatInterval = time.Second
+var gossipWindows = 3  // how many heartbeats of message IDs we gossip about
+var messageWindows = 5 // how many heartbeats we keep messages for IWANT
+
+var pubsubLock sync.Mutex
+var subscriptions = make(map[string]bool)
+var peerTopics = make(map[*Peer]map[string]bool) // what each peer told us it subscribes to
+var meshes = make(map[string]map[*Peer]bool)     // our mesh peers for each topic we subscribe to
+
+type cachedMessage struct {
+	id     string
+	packet Packet
+}
+
+var messageCache = make([][]cachedMessage, 1) // newest window first
+
+func init() {
+	RegisterPayload(9, Subscription{})
+	RegisterPayload(10, TopicControl{})
+	RegisterPayload(11, IHave{})
+	RegisterPayload(12, IWant{})
+}
+
+// the ID gossiped about for a packet
+func packetID(packet Packet) string {
+	return packet.Origin + " " + packet.Timestamp
+}
+
+func Subscribe(topic string) {
+	pubsubLock.Lock()
+	if subscriptions[topic] {
+		pubsubLock.Unlock()
+		return
+	}
+	subscriptions[topic] = true
+	meshes[topic] = make(map[*Peer]bool)
+	pubsubLock.Unlock()
+
+	announceSubscription([]string{topic}, true)
+}
+
+func Unsubscribe(topic string) {
+	pubsubLock.Lock()
+	if !subscriptions[topic] {
+		pubsubLock.Unlock()
+		return
+	}
+	delete(subscriptions, topic)
+	mesh := meshes[topic]
+	delete(meshes, topic)
+	pubsubLock.Unlock()
+
+	for peer := range mesh {
+		sendTopicControl(peer, PRUNE, topic)
+	}
+	announceSubscription([]string{topic}, false)
+}
+
+func announceSubscription(topics []string, subscribe bool) {
+	for peer := range Peers {
+		sendSubscription(peer, topics, subscribe)
+	}
+}
+
+func sendSubscription(peer *Peer, topics []string, subscribe bool) {
+	if len(topics) == 0 {
+		return
+	}
+	sendToPeer(peer, Packet{
+		Type:      SUBSCRIBE,
+		Origin:    localAddress,
+		Payload:   Subscription{Topics: topics, Subscribe: subscribe},
+		Timestamp: time.Now().String(),
+	})
+}
+
+// tells a new peer everything we subscribe to
+func sendSubscriptions(peer *Peer) {
+	pubsubLock.Lock()
+	topics := make([]string, 0, len(subscriptions))
+	for topic := range subscriptions {
+		topics = append(topics, topic)
+	}
+	pubsubLock.Unlock()
+
+	sendSubscription(peer, topics, true)
+}
+
+func sendTopicControl(peer *Peer, packetType PacketType, topic string) {
+	sendToPeer(peer, Packet{
+		Type:      packetType,
+		Origin:    localAddress,
+		Payload:   TopicControl{Topic: topic},
+		Timestamp: time.Now().String(),
+	})
+}
+
+// sends payload to everyone subscribed to topic
+func Publish(topic string, payload interface{}) {
+	packet := Packet{
+		Type:      PUBLISH,
+		Origin:    localAddress,
+		Topic:     topic,
+		Payload:   payload,
+		Timestamp: time.Now().String(),
+	}
+
+	rememberPacket(packet)
+	cacheMessage(packet)
+	forwardPublish(packet, nil)
+}
+
+func recievePublish(packet Packet, from *Peer) {
+	cacheMessage(packet)
+	forwardPublish(packet, from)
+}
+
+// mesh peers if we are subscribed, otherwise any peers we know are subscribed, otherwise everyone
+func forwardPublish(packet Packet, from *Peer) {
+	pubsubLock.Lock()
+	targets := make([]*Peer, 0)
+	if subscriptions[packet.Topic] {
+		for peer := range meshes[packet.Topic] {
+			targets = append(targets, peer)
+		}
+	}
+	if len(targets) == 0 {
+		for peer, topics := range peerTopics {
+			if topics[packet.Topic] {
+				targets = append(targets, peer)
+			}
+		}
+	}
+	pubsubLock.Unlock()
+
+	if len(targets) == 0 {
+		// nobody near us is subscribed, fall back to flooding so it can still find them
+		for peer := range Peers {
+			targets = append(targets, peer)
+		}
+	}
+
+	for _, peer := range targets {
+		if peer != from {
+			sendToPeer(peer, packet)
+		}
+	}
+}
+
+func recieveSubscription(packet Packet, from *Peer) {
+	subscription, ok := packet.Payload.(Subscription)
+	if !ok {
+		log("invalid SUBSCRIBE from " + packet.Origin)
+		return
+	}
+
+	pubsubLock.Lock()
+	defer pubsubLock.Unlock()
+
+	topics, ok := peerTopics[from]
+	if !ok {
+		topics = make(map[string]bool)
+		peerTopics[from] = topics
+	}
+	for _, topic := range subscription.Topics {
+		if subscription.Subscribe {
+			topics[topic] = true
+		} else {
+			delete(topics, topic)
+			delete(meshes[topic], from)
+		}
+	}
+}
+
+func recieveTopicControl(packet Packet, from *Peer) {
+	control, ok := packet.Payload.(TopicControl)
+	if !ok {
+		log("invalid GRAFT/PRUNE from " + packet.Origin)
+		return
+	}
+
+	pubsubLock.Lock()
+	mesh, subscribed := meshes[control.Topic]
+	prune := false
+	switch packet.Type {
+	case GRAFT:
+		if subscribed && len(mesh) < meshHigh {
+			mesh[from] = true
+		} else {
+			prune = true // we cant have them, let them know so they look elsewhere
+		}
+	case PRUNE:
+		if subscribed {
+			delete(mesh, from)
+		}
+	}
+	pubsubLock.Unlock()
+
+	if prune {
+		sendTopicControl(from, PRUNE, control.Topic)
+	}
+}
+
+func recieveIHave(packet Packet, from *Peer) {
+	ihave, ok := packet.Payload.(IHave)
+	if !ok {
+		log("invalid IHAVE from " + packet.Origin)
+		return
+	}
+
+	pubsubLock.Lock()
+	subscribed := subscriptions[ihave.Topic]
+	pubsubLock.Unlock()
+	if !subscribed {
+		return
+	}
+
+	missing := make([]string, 0)
+	for _, id := range ihave.IDs {
+		if !seenPacketID(id) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	sendToPeer(from, Packet{
+		Type:      IWANT,
+		Origin:    localAddress,
+		Payload:   IWant{IDs: missing},
+		Timestamp: time.Now().String(),
+	})
+}
+
+func recieveIWant(packet Packet, from *Peer) {
+	iwant, ok := packet.Payload.(IWant)
+	if !ok {
+		log("invalid IWANT from " + packet.Origin)
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range iwant.IDs {
+		wanted[id] = true
+	}
+
+	pubsubLock.Lock()
+	found := make([]Packet, 0)
+	for _, window := range messageCache {
+		for _, message := range window {
+			if wanted[message.id] {
+				found = append(found, message.packet)
+			}
+		}
+	}
+	pubsubLock.Unlock()
+
+	for _, message := range found {
+		sendToPeer(from, message)
+	}
+}
+
+func cacheMessage(packet Packet) {
+	pubsubLock.Lock()
+	defer pubsubLock.Unlock()
+	messageCache[0] = append(messageCache[0], cachedMessage{id: packetID(packet), packet: packet})
+}
+
+// must be called for every peer that disconnects
+func pubsubPeerRemoved(peer *Peer) {
+	pubsubLock.Lock()
+	defer pubsubLock.Unlock()
+
+	delete(peerTopics, peer)
+	for _, mesh := range meshes {
+		delete(mesh, peer)
+	}
+}
+
+func heartbeatLoop() {
+	for {
+		time.Sleep(heartbeatInterval)
+		heartbeat()
+	}
+}
+
+// keeps each mesh between meshLow and meshHigh, gossips recent message IDs and ages the message cache
+func heartbeat() {
+	grafts := make(map[*Peer][]string)
+	prunes := make(map[*Peer][]string)
+	gossip := make(map[*Peer][]IHave)
+
+	pubsubLock.Lock()
+	for topic, mesh := range meshes {
+		if len(mesh) < meshLow {
+			for peer, topics := range peerTopics {
+				if len(mesh) >= meshTarget {
+					break
+				}
+				if topics[topic] && !mesh[peer] {
+					mesh[peer] = true
+					grafts[peer] = append(grafts[peer], topic)
+				}
+			}
+		}
+		if len(mesh) > meshHigh {
+			for peer := range mesh {
+				if len(mesh) <= meshTarget {
+					break
+				}
+				delete(mesh, peer)
+				prunes[peer] = append(prunes[peer], topic)
+			}
+		}
+
+		// lazy push to subscribed peers outside the mesh
+		ids := make([]string, 0)
+		for i := 0; i < gossipWindows && i < len(messageCache); i++ {
+			for _, message := range messageCache[i] {
+				if message.packet.Topic == topic {
+					ids = append(ids, message.id)
+				}
+			}
+		}
+		if len(ids) > 0 {
+			for peer, topics := range peerTopics {
+				if topics[topic] && !mesh[peer] {
+					gossip[peer] = append(gossip[peer], IHave{Topic: topic, IDs: ids})
+				}
+			}
+		}
+	}
+
+	messageCache = append([][]cachedMessage{{}}, messageCache...)
+	if len(messageCache) > messageWindows {
+		messageCache = messageCache[:messageWindows]
+	}
+	pubsubLock.Unlock()
+
+	for peer, topics := range grafts {
+		for _, topic := range topics {
+			sendTopicControl(peer, GRAFT, topic)
+		}
+	}
+	for peer, topics := range prunes {
+		for _, topic := range topics {
+			sendTopicControl(peer, PRUNE, topic)
+		}
+	}
+	for peer, ihaves := range gossip {
+		for _, ihave := range ihaves {
+			sendToPeer(peer, Packet{
+				Type:      IHAVE,
+				Origin:    localAddress,
+				Payload:   ihave,
+				Timestamp: time.Now().String(),
+			})
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package P2Proto
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// set before calling Setup. we also listen for QUIC over UDP on our TCP port, and peers that do the same are
+// linked over QUIC, where bulk packets have their own stream. everyone else is still reached over TCP
+var QuicEnabled = false
+
+var quicListening = false
+
+const quicALPN = "p2pchat"
+
+// how long a closed connection waits for the other side to read what we last sent
+var quicCloseTimeout = 2 * time.Second
+
+var quicTransport Transport = &quicTransportImpl{}
+
+// peers are not authenticated by TLS, the same as over TCP, QUIC just needs it to run.
+// we make a new certificate each run and dont check theirs
+type quicTransportImpl struct {
+	serverTLS *tls.Config
+	listening *quic.Transport // the UDP socket we listen on, hole punching dials out from it too
+}
+
+func (*quicTransportImpl) Name() string {
+	return "quic"
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  30 * time.Second,
+		KeepAlivePeriod: 10 * time.Second,
+	}
+}
+
+func (t *quicTransportImpl) Listen(addr string) (net.Listener, error) {
+	if t.serverTLS == nil {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, err
+		}
+		t.serverTLS = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{quicALPN}}
+	}
+
+	// quic-go warns on stderr when it cant grow the UDP buffers, which is fine for chat and would mess up the display
+	os.Setenv("QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING", "true")
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: udpConn}
+	listener, err := transport.Listen(t.serverTLS, quicConfig())
+	if err != nil {
+		transport.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	t.listening = transport
+
+	l := &quicListener{listener: listener, transport: transport, accepted: make(chan net.Conn), closed: make(chan bool)}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (*quicTransportImpl) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := quic.DialAddr(ctx, addr, quicClientTLS(), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return openQuicConn(ctx, conn)
+}
+
+// dials from the socket we listen on, so a NAT maps it the same as the packets others saw us send. QUIC keeps
+// resending its first packet until ctx is done, which is what punching through a NAT needs
+func (t *quicTransportImpl) dialFromListenSocket(ctx context.Context, addr string) (net.Conn, error) {
+	if t.listening == nil {
+		return nil, errors.New("not listening for QUIC")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.listening.Dial(ctx, udpAddr, quicClientTLS(), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return openQuicConn(ctx, conn)
+}
+
+func quicClientTLS() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true, NextProtos: []string{quicALPN}}
+}
+
+func openQuicConn(ctx context.Context, conn *quic.Conn) (net.Conn, error) {
+	stream, err := conn.OpenStreamSync(ctx) // the other side only sees it once we write to it, we always write first
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: conn}, nil
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+type quicListener struct {
+	listener  *quic.Listener
+	transport *quic.Transport
+	accepted  chan net.Conn
+	closed    chan bool
+}
+
+func (l *quicListener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			close(l.closed)
+			return
+		}
+		go func() { // dont hold up other connections while this one opens its stream
+			ctx, cancel := context.WithTimeout(context.Background(), tmpConnTimeout)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				conn.CloseWithError(0, "")
+				return
+			}
+			select {
+			case l.accepted <- &quicConn{Stream: stream, conn: conn}:
+			case <-l.closed:
+				conn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("quic listener closed")
+	}
+}
+
+func (l *quicListener) Close() error {
+	err := l.listener.Close()
+	l.transport.Close()
+	l.transport.Conn.Close()
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// the first stream of a QUIC connection, used like a TCP connection
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// like closing a TCP connection, reads stop now but what we already wrote still gets there
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	err := c.Stream.Close()
+	go func() {
+		select {
+		case <-c.conn.Context().Done():
+		case <-time.After(quicCloseTimeout):
+		}
+		c.conn.CloseWithError(0, "")
+	}()
+	return err
+}
+
+func (c *quicConn) openBulk() (bulkWriter, error) {
+	return c.conn.OpenUniStream()
+}
+
+func (c *quicConn) acceptBulk() (io.Reader, error) {
+	return c.conn.AcceptUniStream(context.Background())
+}
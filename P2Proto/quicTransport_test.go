@@ -0,0 +1,47 @@
+package P2Proto
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// hole punching relies on QUIC dialing out from the socket we listen on
+func TestQuicDialFromListenSocket(t *testing.T) {
+	a, b := &quicTransportImpl{}, &quicTransportImpl{}
+	aListener, err := a.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aListener.Close()
+	bListener, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bListener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := a.dialFromListenSocket(ctx, bListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hi")); err != nil { // they only see the stream once we write
+		t.Fatal(err)
+	}
+
+	accepted, err := bListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if accepted.RemoteAddr().String() != aListener.Addr().String() {
+		t.Fatalf("dialed from %s, not the listen socket %s", accepted.RemoteAddr(), aListener.Addr())
+	}
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(accepted, got); err != nil || string(got) != "hi" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
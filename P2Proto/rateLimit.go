@@ -0,0 +1,227 @@
+package P2Proto
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// token bucket limits on what we accept, per peer and per origin, so one node cant flood the network through us.
+// a packet over the limit is dropped, a peer that keeps going over is disconnected
+
+type RateLimit struct {
+	Packets float64 // per second, 0 for no limit
+	Bytes   float64 // per second, 0 for no limit
+	Burst   float64 // how many seconds worth can arrive at once
+}
+
+// set before calling Setup. types without an entry in PeerRateLimits use DefaultPeerRateLimit,
+// types without an entry in OriginRateLimits are not limited by origin
+var DefaultPeerRateLimit = RateLimit{Packets: 100, Bytes: 1 << 20, Burst: 5}
+var PeerRateLimits = map[PacketType]RateLimit{
+	CONN_REQ: {Packets: 2, Bytes: 8 << 10, Burst: 10},
+	MESSAGE:  {Packets: 20, Bytes: 256 << 10, Burst: 5},
+	PUBLISH:  {Packets: 50, Bytes: 512 << 10, Burst: 5},
+	BLOB:     {Packets: 200, Bytes: 8 << 20, Burst: 2},
+	PEX:      {Packets: 0.1, Bytes: 4 << 10, Burst: 30}, // only sent once a connection
+}
+var OriginRateLimits = map[PacketType]RateLimit{
+	CONN_REQ: {Packets: 0.5, Burst: 10},
+	MESSAGE:  {Packets: 5, Bytes: 64 << 10, Burst: 5},
+	PUBLISH:  {Packets: 10, Bytes: 128 << 10, Burst: 5},
+}
+
+// how many packets a peer can have dropped in a burst before we disconnect it, and how fast that forgives
+var throttleTolerance = 50.0
+var throttleRecovery = 1.0 // per second
+
+// forget origins we havent heard from in this long
+var originIdleTime = time.Minute
+
+type PeerStats struct {
+	Packets   int64
+	Bytes     int64
+	Throttled int64 // packets dropped for going over a limit
+
+	Queued      int   // waiting to be sent to them
+	SendDropped int64 // packets to them dropped because their queue was full
+}
+
+type tokenBucket struct {
+	tokens   float64
+	rate     float64
+	capacity float64
+	last     time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{tokens: rate * burst, rate: rate, capacity: rate * burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// something bigger than the whole bucket is let through when the bucket is full, leaving it in debt
+func (b *tokenBucket) has(n float64) bool {
+	return b == nil || b.tokens >= n || b.tokens >= b.capacity
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// a packet bucket and a byte bucket, a nil bucket does not limit
+type limitBuckets struct {
+	packets *tokenBucket
+	bytes   *tokenBucket
+}
+
+func newLimitBuckets(limit RateLimit) *limitBuckets {
+	buckets := &limitBuckets{}
+	if limit.Packets > 0 {
+		buckets.packets = newTokenBucket(limit.Packets, limit.Burst)
+	}
+	if limit.Bytes > 0 {
+		buckets.bytes = newTokenBucket(limit.Bytes, limit.Burst)
+	}
+	return buckets
+}
+
+func (b *limitBuckets) allow(size int, now time.Time) bool {
+	if b.packets != nil {
+		b.packets.refill(now)
+	}
+	if b.bytes != nil {
+		b.bytes.refill(now)
+	}
+	if !b.packets.has(1) || !b.bytes.has(float64(size)) {
+		return false
+	}
+	b.packets.take(1)
+	b.bytes.take(float64(size))
+	return true
+}
+
+// true if nothing has come through for originIdleTime, by then the buckets are full again and no different to new ones
+func (b *limitBuckets) idle(now time.Time) bool {
+	return now.Sub(b.lastUsed()) > originIdleTime
+}
+
+func (b *limitBuckets) lastUsed() time.Time {
+	if b.packets != nil {
+		return b.packets.last
+	}
+	if b.bytes != nil {
+		return b.bytes.last
+	}
+	return time.Time{}
+}
+
+type peerLimiter struct {
+	lock     sync.Mutex
+	buckets  map[PacketType]*limitBuckets
+	patience *tokenBucket
+	stats    PeerStats
+}
+
+var originLock sync.Mutex
+var originBuckets = make(map[string]*limitBuckets) // origin and packet type -> buckets
+
+// checks a packet that arrived from peer against its limits. if it is over them the packet should be dropped,
+// and if the peer has been over them too often it should be disconnected
+func (peer *Peer) allowPacket(packet Packet, size int) (bool, bool) {
+	limiter := &peer.limiter
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	if limiter.buckets == nil {
+		limiter.buckets = make(map[PacketType]*limitBuckets)
+		limiter.patience = newTokenBucket(throttleRecovery, throttleTolerance/throttleRecovery)
+	}
+	limiter.stats.Packets++
+	limiter.stats.Bytes += int64(size)
+
+	buckets, ok := limiter.buckets[packet.Type]
+	if !ok {
+		limit, ok := PeerRateLimits[packet.Type]
+		if !ok {
+			limit = DefaultPeerRateLimit
+		}
+		buckets = newLimitBuckets(limit)
+		limiter.buckets[packet.Type] = buckets
+	}
+
+	if !buckets.allow(size, now) {
+		limiter.stats.Throttled++
+		penalizePeer(peer, offenseRateLimit)
+		limiter.patience.refill(now)
+		limiter.patience.take(1)
+		return false, limiter.patience.tokens < 0
+	}
+
+	// the peer may just be passing on someone elses flood, so only the packet is dropped
+	if !allowOrigin(packet, size, now) {
+		limiter.stats.Throttled++
+		return false, false
+	}
+	return true, false
+}
+
+// duplicates dont count against their origin, they are just the same packet reaching us another way
+func allowOrigin(packet Packet, size int, now time.Time) bool {
+	limit, ok := OriginRateLimits[packet.Type]
+	if !ok || seenPacket(packet) {
+		return true
+	}
+
+	originLock.Lock()
+	defer originLock.Unlock()
+
+	key := packet.Origin + " " + strconv.Itoa(int(packet.Type))
+	buckets, ok := originBuckets[key]
+	if !ok {
+		buckets = newLimitBuckets(limit)
+		originBuckets[key] = buckets
+	}
+	return buckets.allow(size, now)
+}
+
+// what we have recieved from a peer, and what is waiting to go to them
+func (peer *Peer) Stats() PeerStats {
+	peer.limiter.lock.Lock()
+	stats := peer.limiter.stats
+	peer.limiter.lock.Unlock()
+
+	if peer.queue != nil {
+		stats.Queued = len(peer.queue.control) + len(peer.queue.bulk)
+	}
+	return stats
+}
+
+// origins are chosen by the sender, so drop the ones gone quiet before they pile up
+func pruneOrigins() {
+	originLock.Lock()
+	defer originLock.Unlock()
+
+	now := time.Now()
+	for key, buckets := range originBuckets {
+		if buckets.idle(now) {
+			delete(originBuckets, key)
+		}
+	}
+}
+
+func pruneOriginsLoop() {
+	for {
+		time.Sleep(originIdleTime)
+		pruneOrigins()
+	}
+}
@@ -0,0 +1,333 @@
+package P2Proto
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// a node behind a NAT cant be dialed, so it keeps a connection open to a relay and tells others about it in its
+// CONN_REQ. whoever accepts the request and cant dial it directly asks the relay for a circuit instead:
+//
+//	N -> R  RELAY_RESERVE{GID: N}        on a connection N keeps open, R answers with the same packet
+//	A -> R  RELAY_CONNECT{GID: N}        on a new connection, which R holds on to
+//	R -> N  RELAY_CONNECT{Circuit: id}   over the reservation
+//	N -> R  RELAY_CONNECT{Circuit: id}   on another new connection
+//	R -> A  RELAY_CONNECT{Circuit: id}   then R copies between the two
+//
+// A then carries on as if it had dialed N, and N as if A had connected to it. nodes are not authenticated, so a
+// reservation belongs to the host that made it, and the GID has to be the one it sends with every packet
+
+// set before calling Setup, a relay to keep a reservation with when others cant connect to us
+var RelayAddr string
+
+// if we act as a relay for others
+var RelayService = true
+
+// for testing relays on one machine, stop listening once we know our addresses, like a NAT that drops every
+// incoming connection
+var SimulateNat = false
+
+var maxRelayReservations = 32
+var maxRelayCircuits = 64
+
+// how long to wait before trying the relay again after losing our reservation
+var relayRetryDelay = 10 * time.Second
+
+type Relay struct {
+	GID     string `wire:"1"` // who to connect to
+	Circuit string `wire:"2"` // set once the relay has someone waiting for them
+	Addr    string `wire:"3"` // in the relay's answer to RELAY_RESERVE, where the reservation came from
+}
+
+func init() {
+	RegisterPayload(13, Relay{})
+}
+
+type reservation struct {
+	conn      net.Conn
+	host      string     // only this host can take the reservation over, when they reconnect
+	writeLock sync.Mutex // circuits for them can be opened at the same time
+}
+
+type pendingCircuit struct {
+	conn     net.Conn
+	reader   *bufio.Reader // may hold what they sent after RELAY_CONNECT
+	gid      string
+	answered chan bool // closed when the node takes the circuit
+}
+
+var relayLock sync.Mutex
+var relayReservations = make(map[string]*reservation) // GID -> the connection they keep with us
+var pendingCircuits = make(map[string]pendingCircuit) // circuit -> the side waiting for the node to answer
+var relayCircuits = 0
+
+// a connection through a relay, rather than straight to the node
+type relayedConn struct {
+	net.Conn
+}
+
+func (peer *Peer) isRelayed() bool {
+	_, relayed := peer.Connection.(relayedConn)
+	return relayed
+}
+
+func relayPacket(packetType PacketType, relay Relay) Packet {
+	return Packet{
+		Type:      packetType,
+		Origin:    localAddress,
+		Payload:   relay,
+		Timestamp: time.Now().String(),
+	}
+}
+
+// takes over conn, keeping it open as long as they want the reservation
+func recieveRelayReservation(conn net.Conn, reader *bufio.Reader, carrier Carrier) {
+	relay, ok := carrier.Packet.Payload.(Relay)
+	if !RelayService || !ok || relay.GID == "" {
+		sendReject(conn, "not a relay")
+		conn.Close()
+		return
+	}
+	if relay.GID != carrier.Meta.GID {
+		sendReject(conn, "can only reserve for yourself")
+		conn.Close()
+		return
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	relayLock.Lock()
+	old, exists := relayReservations[relay.GID]
+	if exists && old.host != host {
+		relayLock.Unlock()
+		log("refusing reservation for " + relay.GID + " from " + conn.RemoteAddr().String() + ", held by " + old.host)
+		sendReject(conn, "reserved from another host")
+		conn.Close()
+		return
+	}
+	if !exists && len(relayReservations) >= maxRelayReservations {
+		relayLock.Unlock()
+		sendReject(conn, "relay is full")
+		conn.Close()
+		return
+	}
+	ours := &reservation{conn: conn, host: host}
+	relayReservations[relay.GID] = ours
+	relayLock.Unlock()
+	if exists {
+		old.conn.Close() // they reconnected
+	}
+
+	log("relaying for " + relay.GID + " at " + conn.RemoteAddr().String())
+	ours.writeLock.Lock()
+	sendPacket(conn, relayPacket(RELAY_RESERVE, Relay{GID: relay.GID, Addr: conn.RemoteAddr().String()}))
+	ours.writeLock.Unlock()
+
+	// they dont send anything more, reading just tells us when they are gone
+	io.Copy(io.Discard, reader)
+
+	relayLock.Lock()
+	if relayReservations[relay.GID] == ours {
+		delete(relayReservations, relay.GID)
+	}
+	relayLock.Unlock()
+	conn.Close()
+	log("stopped relaying for " + relay.GID)
+}
+
+// takes over conn, either someone asking for a circuit to a node we relay for, or that node answering
+func recieveRelayConnect(conn net.Conn, reader *bufio.Reader, packet Packet) {
+	relay, ok := packet.Payload.(Relay)
+	if !RelayService || !ok {
+		sendReject(conn, "not a relay")
+		conn.Close()
+		return
+	}
+
+	if relay.Circuit != "" { // the node we relay for, ready for the other side
+		relayLock.Lock()
+		waiting, ok := pendingCircuits[relay.Circuit]
+		delete(pendingCircuits, relay.Circuit)
+		relayLock.Unlock()
+		if !ok {
+			conn.Close()
+			return
+		}
+		close(waiting.answered)
+		sendPacket(waiting.conn, relayPacket(RELAY_CONNECT, Relay{GID: waiting.gid, Circuit: relay.Circuit})) // they can go ahead
+		spliceCircuit(waiting.conn, waiting.reader, conn, reader)
+		return
+	}
+
+	relayLock.Lock()
+	reservation, ok := relayReservations[relay.GID]
+	full := relayCircuits+len(pendingCircuits) >= maxRelayCircuits
+	circuit := newCircuitID()
+	answered := make(chan bool)
+	if ok && !full {
+		pendingCircuits[circuit] = pendingCircuit{conn: conn, reader: reader, gid: relay.GID, answered: answered}
+	}
+	relayLock.Unlock()
+	if !ok {
+		sendReject(conn, "no reservation for "+relay.GID)
+		conn.Close()
+		return
+	} else if full {
+		sendReject(conn, "relay is full")
+		conn.Close()
+		return
+	}
+
+	log("opening circuit " + circuit + " from " + conn.RemoteAddr().String() + " to " + relay.GID)
+	reservation.writeLock.Lock()
+	sendPacket(reservation.conn, relayPacket(RELAY_CONNECT, Relay{GID: relay.GID, Circuit: circuit}))
+	reservation.writeLock.Unlock()
+
+	// give up on them if the other side never comes
+	select {
+	case <-answered:
+		return
+	case <-time.After(tmpConnTimeout):
+	}
+	relayLock.Lock()
+	_, stillWaiting := pendingCircuits[circuit]
+	delete(pendingCircuits, circuit)
+	relayLock.Unlock()
+	if stillWaiting {
+		log("circuit " + circuit + " to " + relay.GID + " was never answered")
+		sendReject(conn, relay.GID+" did not answer")
+		conn.Close()
+	}
+}
+
+// copies between the two sides until either closes. the readers may hold what they already sent
+func spliceCircuit(a net.Conn, aReader *bufio.Reader, b net.Conn, bReader *bufio.Reader) {
+	relayLock.Lock()
+	relayCircuits++
+	relayLock.Unlock()
+
+	a.SetDeadline(time.Time{})
+	b.SetDeadline(time.Time{})
+	go func() {
+		io.Copy(b, aReader)
+		b.Close()
+	}()
+	io.Copy(a, bReader)
+	a.Close()
+
+	relayLock.Lock()
+	relayCircuits--
+	relayLock.Unlock()
+}
+
+func newCircuitID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// asks the relay for a circuit to gid, the connection acts like one dialed straight to them.
+// blocks until the relay says they answered
+func requestRelayedConnection(relayAddr string, gid string) (net.Conn, bool) {
+	if isBanned(relayAddr) { // it may be us, thats fine, we go through our own listener
+		return nil, false
+	}
+	log("requesting circuit to " + gid + " through relay " + relayAddr)
+	conn, err := tcpTransport.Dial(relayAddr, tmpConnTimeout)
+	if err != nil {
+		log(err.Error())
+		return nil, false
+	}
+	sendPacket(conn, relayPacket(RELAY_CONNECT, Relay{GID: gid}))
+
+	conn.SetReadDeadline(time.Now().Add(2 * tmpConnTimeout)) // the relay gives them tmpConnTimeout to answer
+	reader := bufio.NewReader(conn)
+	answer := Carrier{}
+	_, err = readCarrier(reader, &answer)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log("no circuit to " + gid + " through " + relayAddr + ": " + err.Error())
+		conn.Close()
+		return nil, false
+	}
+	if answer.Packet.Type != RELAY_CONNECT {
+		if answer.Packet.Type == CONN_REJECT {
+			recieveRejection(answer.Packet)
+		}
+		conn.Close()
+		return nil, false
+	}
+	return relayedConn{bufferedConn{Conn: conn, reader: reader}}, true
+}
+
+// a connection read through a reader that may already hold some of what arrived
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// keeps a reservation with RelayAddr for as long as we run, closing reserved once we first have it
+func keepRelayReservation(reserved chan bool) {
+	var once sync.Once
+	for {
+		err := holdRelayReservation(func() {
+			once.Do(func() { close(reserved) })
+		})
+		log("lost reservation with relay " + RelayAddr + ": " + err.Error() + ", retrying in " + relayRetryDelay.String())
+		time.Sleep(relayRetryDelay)
+	}
+}
+
+func holdRelayReservation(onReserved func()) error {
+	conn, err := dialFromListenPort(RelayAddr, tmpConnTimeout) // so the address the relay sees is worth hole punching to
+
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	sendPacket(conn, relayPacket(RELAY_RESERVE, Relay{GID: GID}))
+
+	reader := bufio.NewReader(conn)
+	for {
+		carrier := &Carrier{}
+		_, err := readCarrier(reader, carrier)
+		if err != nil {
+			return err
+		}
+
+		switch carrier.Packet.Type {
+		case RELAY_RESERVE:
+			log("reachable through relay " + RelayAddr)
+			if relay, ok := carrier.Packet.Payload.(Relay); ok {
+				addressObservedByRelay(relay.Addr)
+			}
+			onReserved()
+		case RELAY_CONNECT:
+			relay, ok := carrier.Packet.Payload.(Relay)
+			if ok && relay.Circuit != "" {
+				go answerCircuit(relay.Circuit)
+			}
+		case CONN_REJECT:
+			recieveRejection(carrier.Packet)
+		}
+	}
+}
+
+// connects back to the relay for someone waiting on a circuit, then handles it like any incoming connection
+func answerCircuit(circuit string) {
+	conn, err := tcpTransport.Dial(RelayAddr, tmpConnTimeout)
+	if err != nil {
+		log("could not answer circuit " + circuit + ": " + err.Error())
+		return
+	}
+	sendPacket(conn, relayPacket(RELAY_CONNECT, Relay{GID: GID, Circuit: circuit}))
+	handleConnection(relayedConn{conn})
+}
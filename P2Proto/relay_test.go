@@ -0,0 +1,151 @@
+package P2Proto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runs a relay on loopback, returning its address. it is stopped, and its connections closed, once the test ends
+func startTestRelay(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handlers sync.WaitGroup
+	var connsLock sync.Mutex
+	conns := make([]net.Conn, 0)
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			connsLock.Lock()
+			conns = append(conns, conn)
+			connsLock.Unlock()
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				handleConnection(conn)
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+		connsLock.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		connsLock.Unlock()
+		handlers.Wait()
+	})
+	return l.Addr().String()
+}
+
+// sends RELAY_RESERVE as gid from the local address, returning the connection and the relay's answer
+func reserveTestRelay(t *testing.T, relayAddr string, localHost string, gid string) (net.Conn, *bufio.Reader, Packet) {
+	dialer := net.Dialer{Timeout: time.Second, LocalAddr: &net.TCPAddr{IP: net.ParseIP(localHost)}}
+	conn, err := dialer.Dial("tcp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	reserve := Carrier{Packet: relayPacket(RELAY_RESERVE, Relay{GID: gid}), Meta: PeerMeta{GID: gid}}
+	if err := writeCarrier(conn, reserve); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+	answer := Carrier{}
+	if _, err := readCarrier(reader, &answer); err != nil {
+		t.Fatalf("no answer to RELAY_RESERVE: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, reader, answer.Packet
+}
+
+func TestRelayCircuit(t *testing.T) {
+	relayAddr := startTestRelay(t)
+	_, reservation, answer := reserveTestRelay(t, relayAddr, "127.0.0.1", "node")
+	if answer.Type != RELAY_RESERVE {
+		t.Fatalf("reservation answered with %d", answer.Type)
+	}
+
+	// the node answers the circuit the relay tells it about
+	go func() {
+		carrier := Carrier{}
+		if _, err := readCarrier(reservation, &carrier); err != nil {
+			return
+		}
+		relay, _ := carrier.Packet.Payload.(Relay)
+		conn, err := net.Dial("tcp", relayAddr)
+		if err != nil {
+			return
+		}
+		writeCarrier(conn, Carrier{Packet: relayPacket(RELAY_CONNECT, Relay{Circuit: relay.Circuit}), Meta: PeerMeta{GID: "node"}})
+		io.Copy(conn, conn) // echo
+	}()
+
+	conn, ok := requestRelayedConnection(relayAddr, "node")
+	if !ok {
+		t.Fatalf("could not open a circuit")
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, 5)
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "hello" {
+		t.Fatalf("circuit echoed %q, %v", echoed, err)
+	}
+}
+
+func TestRelayWithoutReservation(t *testing.T) {
+	relayAddr := startTestRelay(t)
+	if _, ok := requestRelayedConnection(relayAddr, "nobody"); ok {
+		t.Fatalf("got a circuit to a node without a reservation")
+	}
+}
+
+func TestRelayRefusesTakeover(t *testing.T) {
+	relayAddr := startTestRelay(t)
+	reserveTestRelay(t, relayAddr, "127.0.0.1", "node")
+
+	_, _, answer := reserveTestRelay(t, relayAddr, "127.0.0.2", "node")
+	if answer.Type != CONN_REJECT {
+		t.Fatalf("another host took over the reservation")
+	}
+
+	_, _, answer = reserveTestRelay(t, relayAddr, "127.0.0.1", "node")
+	if answer.Type != RELAY_RESERVE {
+		t.Fatalf("the same host could not reconnect")
+	}
+}
+
+func TestRelayOnlyReservesForSender(t *testing.T) {
+	relayAddr := startTestRelay(t)
+
+	conn, err := net.Dial("tcp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeCarrier(conn, Carrier{Packet: relayPacket(RELAY_RESERVE, Relay{GID: "someone else"}), Meta: PeerMeta{GID: "node"}})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	answer := Carrier{}
+	if _, err := readCarrier(bufio.NewReader(conn), &answer); err != nil || answer.Packet.Type != CONN_REJECT {
+		t.Fatalf("reserved for a GID other than the sender's")
+	}
+}
@@ -0,0 +1,252 @@
+package P2Proto
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every node starts with a score of 0, misbehaving lowers it and it slowly recovers.
+// a node whose score falls to BanThreshold is banned for BanDuration
+
+// where the ban list is saved between runs, set before calling Setup
+var BanListPath = "bans.json"
+
+var BanThreshold = -100.0
+var BanDuration = 24 * time.Hour
+
+// points a score recovers per minute
+var scoreRecovery = 2.0
+
+type offense int
+
+const (
+	offenseDecode      offense = iota // sent something we could not decode
+	offenseRateLimit                  // went over a per peer rate limit
+	offenseDuplicate                  // sent us the same packet twice
+	offenseInvalid                    // sent data that failed verification, like a blob not matching its hash
+	offenseUnsolicited                // sent a blob nobody asked for
+)
+
+var penalties = map[offense]float64{
+	offenseDecode:      40,
+	offenseRateLimit:   2,
+	offenseDuplicate:   5,
+	offenseInvalid:     25,
+	offenseUnsolicited: 10,
+}
+
+var offenseNames = map[offense]string{
+	offenseDecode:      "undecodable data",
+	offenseRateLimit:   "going over the rate limit",
+	offenseDuplicate:   "duplicate packets",
+	offenseInvalid:     "invalid data",
+	offenseUnsolicited: "unrequested blobs",
+}
+
+// how many packet IDs we remember per peer to spot duplicates
+var maxRememberedPerPeer = 1024
+
+type score struct {
+	value float64
+	last  time.Time
+}
+
+var reputationLock sync.Mutex
+var scores = make(map[string]*score)
+var banList map[string]time.Time // GID or host -> when the ban ends, nil until loaded from disk
+
+// must hold reputationLock
+func loadBanList() {
+	if banList != nil {
+		return
+	}
+	banList = make(map[string]time.Time)
+
+	encoded, err := os.ReadFile(BanListPath)
+	if err != nil {
+		return // first run
+	}
+	err = json.Unmarshal(encoded, &banList)
+	if err != nil {
+		log("invalid ban list: " + err.Error())
+		banList = make(map[string]time.Time)
+	}
+}
+
+// must hold reputationLock
+func saveBanList() {
+	encoded, err := json.Marshal(banList)
+	if err != nil {
+		log(err.Error())
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(BanListPath), 0700)
+	if err != nil {
+		log(err.Error())
+		return
+	}
+	err = os.WriteFile(BanListPath, encoded, 0600)
+	if err != nil {
+		log(err.Error())
+	}
+}
+
+// who a peer is for scoring and bans. a GID is whatever the peer says it is, anyone could claim another's to get it
+// banned, so it is the host they connect from. a relayed connection comes from the relay's host, so it is just that
+// connection, not everyone behind the relay
+func peerName(peer *Peer) string {
+	addr := peer.Connection.RemoteAddr().String()
+	if peer.isRelayed() {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func penalizePeer(peer *Peer, o offense) {
+	if peer != nil {
+		penalize(peerName(peer), o)
+	}
+}
+
+func penalize(who string, o offense) {
+	reputationLock.Lock()
+	s, ok := scores[who]
+	if !ok {
+		s = &score{last: time.Now()}
+		scores[who] = s
+	}
+	s.value += time.Since(s.last).Minutes() * scoreRecovery
+	if s.value > 0 {
+		s.value = 0
+	}
+	s.last = time.Now()
+	s.value -= penalties[o]
+	value := s.value
+	reputationLock.Unlock()
+
+	log("penalized " + who + " for " + offenseNames[o] + ", score " + strconv.FormatFloat(value, 'f', 0, 64))
+	if value <= BanThreshold {
+		Ban(who, BanDuration)
+	}
+}
+
+// bans a GID, or a host to ban every node on it, and disconnects them. bans for misbehaving are always by host,
+// see peerName
+func Ban(who string, duration time.Duration) {
+	who = banName(who)
+	reputationLock.Lock()
+	loadBanList()
+	banList[who] = time.Now().Add(duration)
+	delete(scores, who)
+	saveBanList()
+	reputationLock.Unlock()
+
+	logEvent("ban", "banned "+who+" for "+duration.String(), "who", who, "duration", duration.String())
+
+	// Peers belongs to the Setup loop, nil asks it to drop whoever is now banned
+	select {
+	case <-ready:
+		removePeerChan <- nil
+	default: // not set up yet, handlePeer will refuse them
+	}
+}
+
+// only called from the Setup loop
+func dropBannedPeers() {
+	for peer := range Peers {
+		if isBanned(peer.Meta.GID) || isBanned(peer.Connection.RemoteAddr().String()) {
+			peer.Connection.Close() // handlePeer cleans up after it
+		}
+	}
+}
+
+// returns false if who was not banned
+func Unban(who string) bool {
+	who = banName(who)
+	reputationLock.Lock()
+	defer reputationLock.Unlock()
+	loadBanList()
+
+	_, ok := banList[who]
+	delete(banList, who)
+	saveBanList()
+	return ok
+}
+
+// IPv6 hosts can be given in brackets, but are matched against hosts without them
+func banName(who string) string {
+	if strings.HasPrefix(who, "[") && strings.HasSuffix(who, "]") {
+		return who[1 : len(who)-1]
+	}
+	return who
+}
+
+// everyone banned, and when their ban ends
+func Bans() map[string]time.Time {
+	reputationLock.Lock()
+	defer reputationLock.Unlock()
+	loadBanList()
+
+	bans := make(map[string]time.Time)
+	for who, until := range banList {
+		if time.Now().Before(until) {
+			bans[who] = until
+		}
+	}
+	return bans
+}
+
+// true if addr, or the host it is on, is banned
+func isBanned(addr string) bool {
+	if addr == "" {
+		return false
+	}
+
+	reputationLock.Lock()
+	defer reputationLock.Unlock()
+	loadBanList()
+
+	names := []string{addr}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		names = append(names, host)
+	}
+	for _, name := range names {
+		until, ok := banList[name]
+		if !ok {
+			continue
+		}
+		if time.Now().Before(until) {
+			return true
+		}
+		delete(banList, name) // expired
+		saveBanList()
+	}
+	return false
+}
+
+// true if peer has already sent us this packet. only called from the peer's handlePeer
+func (peer *Peer) repeated(packet Packet) bool {
+	if packet.Timestamp == "" { // BLANKs only carry meta data, they are all the same
+		return false
+	}
+	if peer.sent == nil || len(peer.sent) >= maxRememberedPerPeer {
+		peer.sent = make(map[string]bool)
+	}
+	id := packetID(packet)
+	if peer.sent[id] {
+		return true
+	}
+	peer.sent[id] = true
+	return false
+}
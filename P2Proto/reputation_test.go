@@ -0,0 +1,46 @@
+package P2Proto
+
+import (
+	"net"
+	"testing"
+)
+
+// a connection that only knows where it comes from
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestBanByHostNotGID(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}
+	peer := &Peer{Connection: addrConn{remote: remote}, Meta: PeerMeta{GID: "someone else"}}
+	t.Cleanup(func() {
+		Unban("203.0.113.7")
+		Unban("someone else")
+	})
+
+	for i := 0; !isBanned(remote.String()); i++ {
+		if i > 100 {
+			t.Fatalf("never banned")
+		}
+		penalizePeer(peer, offenseDecode)
+	}
+	if isBanned("someone else") {
+		t.Errorf("banned the GID they claimed")
+	}
+	if !isBanned("203.0.113.7:5000") {
+		t.Errorf("other ports on the host not banned")
+	}
+}
+
+func TestRelayedPeerBannedAlone(t *testing.T) {
+	relay := &net.TCPAddr{IP: net.ParseIP("203.0.113.8"), Port: 4000}
+	peer := &Peer{Connection: relayedConn{addrConn{remote: relay}}}
+	if name := peerName(peer); name != relay.String() {
+		t.Fatalf("relayed peer is known as %s", name)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin
+
+package P2Proto
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// lets hole punching dial out from the port we listen on, while we are still listening on it
+const canReusePort = true
+
+func reusePort(network string, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
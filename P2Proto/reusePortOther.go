@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package P2Proto
+
+import (
+	"syscall"
+)
+
+// hole punching dials from any port instead, which only gets through the simplest NATs
+const canReusePort = false
+
+func reusePort(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package P2Proto
+
+import (
+	"strconv"
+	"time"
+)
+
+// packets to a peer are queued and written by its own goroutine, so a slow peer only slows itself down.
+// control packets are written before chat and file data. when the bulk queue is full new packets are dropped,
+// when the control queue is full the peer cant keep up with the protocol and is disconnected
+
+type sendQueue struct {
+	control chan Packet
+	bulk    chan Packet
+	done    chan bool
+}
+
+var controlQueueSize = 256
+var bulkQueueSize = 1024
+
+// a peer that cant take a packet in this long is disconnected
+var writeTimeout = 10 * time.Second
+
+// the rest are control packets
+var bulkPackets = map[PacketType]bool{
+	MESSAGE: true,
+	PUBLISH: true,
+	DIRECT:  true,
+	BLOB:    true,
+}
+
+func (peer *Peer) startWriter() {
+	peer.queue = &sendQueue{
+		control: make(chan Packet, controlQueueSize),
+		bulk:    make(chan Packet, bulkQueueSize),
+		done:    make(chan bool),
+	}
+	go peer.writeLoop(peer.queue)
+}
+
+func (peer *Peer) stopWriter() {
+	close(peer.queue.done)
+}
+
+// pubsub control packets only ever go to one peer, so they never come back to us and arent worth remembering
+var unforwardedPackets = map[PacketType]bool{
+	GRAFT: true,
+	PRUNE: true,
+	IHAVE: true,
+	IWANT: true,
+}
+
+// doesnt block once the peer is handled, before that (queue is nil) it writes the packet itself
+func queuePacket(peer *Peer, packet Packet) {
+	queue := peer.queue
+	if queue == nil { // not handled yet, nothing else can be writing to it
+		sendPacket(peer.Connection, packet)
+		return
+	}
+	if !unforwardedPackets[packet.Type] {
+		rememberPacket(packet)
+	}
+
+	if bulkPackets[packet.Type] {
+		select {
+		case queue.bulk <- packet:
+		default:
+			dropped := peer.sendDropped()
+			if dropped%100 == 1 {
+				log("send queue to " + peerName(peer) + " is full, " + strconv.FormatInt(dropped, 10) + " packets dropped")
+			}
+		}
+		return
+	}
+
+	select {
+	case queue.control <- packet:
+	default:
+		log("dropping " + peerName(peer) + ", cant keep up with what we send")
+		peer.Connection.Close() // handlePeer cleans up after it
+	}
+}
+
+func (peer *Peer) writeLoop(queue *sendQueue) {
+	for {
+		var packet Packet
+		select {
+		case packet = <-queue.control:
+		default:
+			select {
+			case packet = <-queue.control:
+			case packet = <-queue.bulk:
+			case <-queue.done:
+				return
+			}
+		}
+
+		w := peer.writerFor(packet)
+		w.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err := writePeerCarrier(peer, w, Carrier{Packet: packet, Meta: getMyMeta()})
+		if err == errCarrierTooBig {
+			log(err.Error())
+		} else if err != nil {
+			logEvent("error", "dropping "+peerName(peer)+", could not write: "+err.Error(),
+				"peer", peer.Meta.GID, "addr", peer.Connection.RemoteAddr().String(), "error", err.Error())
+			peer.Connection.Close()
+			return
+		}
+	}
+}
+
+// counts a packet we could not queue, returning how many have been dropped
+func (peer *Peer) sendDropped() int64 {
+	peer.limiter.lock.Lock()
+	defer peer.limiter.lock.Unlock()
+	peer.limiter.stats.SendDropped++
+	return peer.limiter.stats.SendDropped
+}
@@ -0,0 +1,119 @@
+package P2Proto
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// how connections to other nodes are made. everything above works on a net.Conn, a transport that can keep
+// traffic classes apart also gives its connections a separate stream for bulk packets (see bulkConn)
+type Transport interface {
+	Name() string
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error) // no timeout if 0
+}
+
+// every node listens over TCP, tmp connections and bootstrapping always use it
+var tcpTransport Transport = tcpTransportImpl{}
+
+type tcpTransportImpl struct{}
+
+func (tcpTransportImpl) Name() string {
+	return "tcp"
+}
+
+// the port can be shared so hole punching can dial out from it
+func (tcpTransportImpl) Listen(addr string) (net.Listener, error) {
+	// sharing would also let a second node take the same port without an error, so check nobody has it first
+	probe, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	probe.Close()
+
+	config := net.ListenConfig{Control: reusePort}
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+func (tcpTransportImpl) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// a connection with a stream for bulk packets next to the one for everything else, so a big BLOB doesnt hold up
+// control packets or chat behind it. each side opens its own bulk stream the first time it has bulk to send
+type bulkConn interface {
+	openBulk() (bulkWriter, error)
+	acceptBulk() (io.Reader, error) // blocks until the other side opens theirs
+}
+
+type bulkWriter interface {
+	io.WriteCloser
+	SetWriteDeadline(time.Time) error
+}
+
+// the transport to dial a peer link with, given the features we share with them
+func peerTransport(features Feature) Transport {
+	if features&FEATURE_QUIC != 0 && quicListening {
+		return quicTransport
+	}
+	return tcpTransport
+}
+
+// where the writer should put a packet, the bulk stream if the connection has one
+func (peer *Peer) writerFor(packet Packet) bulkWriter {
+	if !bulkPackets[packet.Type] || peer.bulkFailed {
+		return peer.Connection
+	}
+	if peer.bulk == nil {
+		conn, ok := peer.Connection.(bulkConn)
+		if !ok {
+			return peer.Connection
+		}
+		bulk, err := conn.openBulk()
+		if err != nil {
+			log("could not open bulk stream to " + peerName(peer) + ", sending everything together: " + err.Error())
+			peer.bulkFailed = true
+			return peer.Connection
+		}
+		peer.bulk = bulk
+	}
+	return peer.bulk
+}
+
+type recievedCarrier struct {
+	carrier Carrier
+	size    int
+	err     error
+}
+
+// reads carriers into incoming until one fails, or handlePeer is done with them
+func readLoop(r *bufio.Reader, incoming chan recievedCarrier, done chan bool) {
+	for {
+		carrier := Carrier{}
+		size, err := readCarrier(r, &carrier)
+		select {
+		case incoming <- recievedCarrier{carrier: carrier, size: size, err: err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reads the other side's bulk stream, if the connection can have one
+func readBulkLoop(peer *Peer, incoming chan recievedCarrier, done chan bool) {
+	conn, ok := peer.Connection.(bulkConn)
+	if !ok {
+		return
+	}
+	bulk, err := conn.acceptBulk()
+	if err != nil { // the connection closed before they sent anything bulk
+		return
+	}
+	readLoop(bufio.NewReader(bulk), incoming, done)
+}
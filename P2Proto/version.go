@@ -0,0 +1,155 @@
+package P2Proto
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bump ProtocolVersion on any change to Packet, Carrier or the handshake that older nodes would misread, and
+// MinProtocolVersion when we can no longer understand older nodes. new packet types dont need a bump, on a peer link
+// they go behind a Feature so they are only sent to peers that said they understand them (see packetFeatures), and
+// on a tmp connection (like RELAY_*) a node that doesnt know the type just closes it. nodes from before versioning
+// send no handshake and count as version 0
+const ProtocolVersion = 2
+const MinProtocolVersion = 1
+
+// optional parts of the protocol, only used on a link when both sides support them
+type Feature uint32
+
+const (
+	FEATURE_BLOBS Feature = 1 << iota
+	FEATURE_PEX
+	FEATURE_DHT
+	FEATURE_PUBSUB
+	FEATURE_COMPRESSION
+	FEATURE_QUIC // accepts QUIC on the same port as TCP, only supported once we are listening
+	FEATURE_HOLEPUNCH
+)
+
+var supportedFeatures = FEATURE_BLOBS | FEATURE_PEX | FEATURE_DHT | FEATURE_PUBSUB | FEATURE_COMPRESSION
+
+var featureNames = map[Feature]string{
+	FEATURE_BLOBS:       "blobs",
+	FEATURE_PEX:         "pex",
+	FEATURE_DHT:         "dht",
+	FEATURE_PUBSUB:      "pubsub",
+	FEATURE_COMPRESSION: "compression",
+	FEATURE_QUIC:        "quic",
+	FEATURE_HOLEPUNCH:   "holepunch",
+}
+
+// payload of CONN_REQ and CONN_ACK
+type Handshake struct {
+	Version    int     `wire:"1"`
+	MinVersion int     `wire:"2"`
+	Features   Feature `wire:"3"`
+
+	// in CONN_ACK, the address we reached the requester at. in CONN_REQ, where the first node it reached saw it come from
+	ObservedAddr string   `wire:"4"`
+	Addrs        []string `wire:"5"` // other addresses the sender can be reached at
+
+	Relay string `wire:"6"` // in CONN_REQ, a relay to reach the sender through if its addresses dont work
+	GID   string `wire:"7"` // the sender's, for asking the relay
+}
+
+// sent instead of CONN_ACK when we wont accept a node
+type Rejection struct {
+	Reason string `wire:"1"`
+}
+
+func init() {
+	RegisterPayload(1, Handshake{})
+	RegisterPayload(2, Rejection{})
+}
+
+func myHandshake() Handshake {
+	return Handshake{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Features:   supportedFeatures,
+		Addrs:      ourAddresses(),
+		Relay:      RelayAddr,
+		GID:        GID,
+	}
+}
+
+// checks we can talk to the sender of a CONN_REQ or CONN_ACK, returning the features we can both use
+func checkHandshake(packet Packet) (Feature, bool, string) {
+	handshake, ok := packet.Payload.(Handshake)
+	if !ok {
+		return 0, false, "no protocol version, they are running a version from before versioning"
+	}
+	if handshake.Version < MinProtocolVersion {
+		return 0, false, "they speak protocol version " + strconv.Itoa(handshake.Version) + ", we need at least " + strconv.Itoa(MinProtocolVersion)
+	}
+	if ProtocolVersion < handshake.MinVersion {
+		return 0, false, "they need protocol version " + strconv.Itoa(handshake.MinVersion) + ", we only speak " + strconv.Itoa(ProtocolVersion)
+	}
+	return handshake.Features & supportedFeatures, true, ""
+}
+
+func (f Feature) String() string {
+	names := make([]string, 0)
+	for flag := Feature(1); flag != 0; flag <<= 1 {
+		if f&flag != 0 {
+			name, ok := featureNames[flag]
+			if !ok {
+				name = "unknown(" + strconv.Itoa(int(flag)) + ")"
+			}
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// which feature a peer needs to understand each packet type, packets not listed are always understood
+var packetFeatures = map[PacketType]Feature{
+	WANT:      FEATURE_BLOBS,
+	HAVE:      FEATURE_BLOBS,
+	BLOB:      FEATURE_BLOBS,
+	PEX:       FEATURE_PEX,
+	SUBSCRIBE: FEATURE_PUBSUB,
+	PUBLISH:   FEATURE_PUBSUB,
+	GRAFT:     FEATURE_PUBSUB,
+	PRUNE:     FEATURE_PUBSUB,
+	IHAVE:     FEATURE_PUBSUB,
+	IWANT:     FEATURE_PUBSUB,
+
+	CONNECT_VIA: FEATURE_HOLEPUNCH,
+}
+
+func (peer *Peer) supports(f Feature) bool {
+	return peer.Features&f == f
+}
+
+// sends packet to peer, unless they wouldnt understand it
+func sendToPeer(peer *Peer, packet Packet) {
+	if !peer.supports(packetFeatures[packet.Type]) {
+		return
+	}
+	queuePacket(peer, packet)
+}
+
+func sendReject(c net.Conn, reason string) {
+	log("sending CONN_REJECT to " + c.RemoteAddr().String() + ": " + reason)
+	reject := Packet{
+		Type:      CONN_REJECT,
+		Origin:    localAddress,
+		Payload:   Rejection{Reason: reason},
+		Timestamp: time.Now().String(),
+	}
+	sendPacket(c, reject)
+}
+
+func recieveRejection(packet Packet) {
+	rejection, ok := packet.Payload.(Rejection)
+	if !ok {
+		rejection.Reason = "no reason given"
+	}
+	log("connection refused by " + packet.Origin + ": " + rejection.Reason)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonfantl/P2PChat/P2Proto"
+)
+
+// a local HTTP API for scripts, JSON in and out. it listens on a host:port, or a unix socket given as unix:<path>,
+// and every request needs the token from the token file as "Authorization: Bearer <token>". /events also takes it as
+// ?token=<token>, since EventSource cant set headers:
+//
+//	GET    /rooms                        rooms we are in
+//	POST   /rooms                        join one, {"name": "...", "key": "<hex>"}
+//	DELETE /rooms/{name}                 leave one
+//	GET    /rooms/{name}/history?limit=n what was said, oldest first
+//	POST   /rooms/{name}/messages        send {"text": "..."} to the room
+//	GET    /peers                        who we are connected to
+//	GET    /events                       server-sent events: message, rooms, peers and log
+//
+// eg. curl -H "Authorization: Bearer $(cat p2pchat_data_1234/api_token)" localhost:8080/rooms
+
+type apiRoom struct {
+	Name    string `json:"name"`
+	Current bool   `json:"current"` // the room selected in the UI
+	Files   int    `json:"files"`
+}
+
+type apiPeer struct {
+	GID         string `json:"gid"`
+	ListenAddr  string `json:"listen_addr"`
+	RemoteAddr  string `json:"remote_addr"`
+	Connections int    `json:"connections"` // how many peers they have
+	Packets     int64  `json:"rx_packets"`
+	Bytes       int64  `json:"rx_bytes"`
+	Throttled   int64  `json:"throttled"`
+	Queued      int    `json:"tx_queued"`
+	SendDropped int64  `json:"tx_dropped"`
+}
+
+type apiEvent struct {
+	Kind string
+	Data interface{}
+}
+
+type apiMessage struct {
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+// a copy of the peer list from the last update, P2Proto.Peers changes under us
+var peersLock sync.Mutex
+var peerSnapshot []apiPeer
+var peerLineSnapshot []string
+
+// each /events stream and web UI has a channel here
+var eventsLock sync.Mutex
+var eventStreams = make(map[chan apiEvent]bool)
+
+// events a stream hasnt read yet, once full it misses new ones rather than holding up the node
+const eventBuffer = 256
+
+// starts serving the API on addr, the returned func stops it
+func setupAPI(addr string, token string) (func(), error) {
+	var listener net.Listener
+	var err error
+	if path, isUnix := strings.CutPrefix(addr, "unix:"); isUnix {
+		listener, err = listenUnix(path)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: apiHandler(token)}
+	go server.Serve(listener)
+	logger("API listening on " + addr)
+
+	return func() {
+		server.Close()
+	}, nil
+}
+
+func apiHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	apiRoutes(mux)
+	return requireToken(token, mux)
+}
+
+func apiRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /rooms", serveRooms)
+	mux.HandleFunc("POST /rooms", serveJoinRoom)
+	mux.HandleFunc("DELETE /rooms/{name}", serveLeaveRoom)
+	mux.HandleFunc("GET /rooms/{name}/history", serveHistory)
+	mux.HandleFunc("POST /rooms/{name}/messages", serveSendMessage)
+	mux.HandleFunc("GET /peers", servePeers)
+	mux.HandleFunc("GET /events", serveEvents)
+}
+
+// reads the token, making one on the first run
+func loadAPIToken(path string) (string, error) {
+	encoded, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(encoded))
+		if token == "" {
+			return "", errors.New(path + " is empty")
+		}
+		return token, nil
+	}
+
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	return token, os.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer {
+			given = ""
+		}
+		if given == "" && r.Method == http.MethodGet && r.URL.Path == "/events" {
+			given = r.URL.Query().Get("token") // EventSource cant set headers
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func serveRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := make([]apiRoom, 0)
+	for _, name := range client.Rooms() {
+		files, _ := client.Files(name)
+		rooms = append(rooms, apiRoom{Name: name, Current: name == currentRoom(), Files: len(files)})
+	}
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+func serveJoinRoom(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key, err := hex.DecodeString(request.Key)
+	if err == nil && request.Name != "" {
+		err = client.JoinRoom(request.Name, key)
+	}
+	if request.Name == "" || err != nil {
+		writeError(w, http.StatusBadRequest, "need a name and a key of 32, 48 or 64 hex characters")
+		return
+	}
+	writeJSON(w, http.StatusOK, apiRoom{Name: request.Name, Current: request.Name == currentRoom()})
+}
+
+func serveLeaveRoom(w http.ResponseWriter, r *http.Request) {
+	err := client.LeaveRoom(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, apiRoom{Name: r.PathValue("name")})
+}
+
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := client.History(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a number")
+			return
+		}
+		if n < len(history) {
+			history = history[len(history)-n:]
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room": r.PathValue("name"), "history": history})
+}
+
+func serveSendMessage(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Text string `json:"text"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Text == "" {
+		writeError(w, http.StatusBadRequest, "need some text")
+		return
+	}
+	err = client.Send(r.PathValue("name"), request.Text)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, apiMessage{Room: r.PathValue("name"), Text: request.Text})
+}
+
+func servePeers(w http.ResponseWriter, r *http.Request) {
+	peersLock.Lock()
+	peers := append([]apiPeer{}, peerSnapshot...)
+	peersLock.Unlock()
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "cannot stream")
+		return
+	}
+	events := subscribeEvents()
+	defer unsubscribeEvents(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			encoded, err := json.Marshal(event.Data)
+			if err != nil {
+				continue
+			}
+			_, err = w.Write([]byte("event: " + event.Kind + "\ndata: " + string(encoded) + "\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C: // a comment, so proxies dont close a quiet stream
+			w.Write([]byte(": keep alive\n\n"))
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func subscribeEvents() chan apiEvent {
+	events := make(chan apiEvent, eventBuffer)
+	eventsLock.Lock()
+	eventStreams[events] = true
+	eventsLock.Unlock()
+	return events
+}
+
+func unsubscribeEvents(events chan apiEvent) {
+	eventsLock.Lock()
+	delete(eventStreams, events)
+	eventsLock.Unlock()
+}
+
+// passes an event to every /events stream
+func publishEvent(kind string, data interface{}) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	for events := range eventStreams {
+		select {
+		case events <- apiEvent{Kind: kind, Data: data}:
+		default: // they are too slow, dont wait on them
+		}
+	}
+}
+
+func rememberPeers(peers P2Proto.PeerList) {
+	snapshot := make([]apiPeer, 0, len(peers))
+	for peer := range peers {
+		stats := peer.Stats()
+		snapshot = append(snapshot, apiPeer{
+			GID:         peer.Meta.GID,
+			ListenAddr:  peer.Meta.ListenAddr,
+			RemoteAddr:  peer.Connection.RemoteAddr().String(),
+			Connections: peer.Meta.ConnectionCount,
+			Packets:     stats.Packets,
+			Bytes:       stats.Bytes,
+			Throttled:   stats.Throttled,
+			Queued:      stats.Queued,
+			SendDropped: stats.SendDropped,
+		})
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].GID < snapshot[j].GID })
+	lines := peerLines(peers)
+
+	peersLock.Lock()
+	changed := len(snapshot) != len(peerSnapshot)
+	for i := 0; !changed && i < len(snapshot); i++ {
+		changed = snapshot[i].GID != peerSnapshot[i].GID
+	}
+	peerSnapshot = snapshot
+	peerLineSnapshot = lines
+	peersLock.Unlock()
+
+	if changed { // updates come with every packet, only tell streams when someone comes or goes
+		publishEvent("peers", snapshot)
+	}
+}
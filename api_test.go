@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonfantl/P2PChat/Chat"
+)
+
+const testToken = "secret"
+
+// an API server in front of a fresh client, not connected to anyone
+func startTestAPI(t *testing.T) *httptest.Server {
+	client = Chat.NewClient(t.TempDir(), func(string) {})
+	setCurrentRoom("")
+
+	server := httptest.NewServer(apiHandler(testToken))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func apiRequest(t *testing.T, server *httptest.Server, method string, path string, body string, token string) (int, map[string]interface{}) {
+	request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	decoded := map[string]interface{}{}
+	if response.Header.Get("Content-Type") == "application/json" { // not /events, which never ends
+		json.NewDecoder(response.Body).Decode(&decoded) // lists decode to nothing, only the status matters for them
+	}
+	return response.StatusCode, decoded
+}
+
+func TestAPIToken(t *testing.T) {
+	server := startTestAPI(t)
+
+	cases := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"no token", "/rooms", "", http.StatusUnauthorized},
+		{"wrong token", "/rooms", "wrong", http.StatusUnauthorized},
+		{"header", "/rooms", testToken, http.StatusOK},
+		{"query on rooms", "/rooms?token=" + testToken, "", http.StatusUnauthorized},
+		{"query on events", "/events?token=" + testToken, "", http.StatusOK},
+		{"wrong query on events", "/events?token=wrong", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		status, _ := apiRequest(t, server, "GET", c.path, "", c.token)
+		if status != c.status {
+			t.Errorf("%s: got %d, expected %d", c.name, status, c.status)
+		}
+	}
+
+	// only the exact Bearer form counts
+	request, _ := http.NewRequest("GET", server.URL+"/rooms", nil)
+	request.Header.Set("Authorization", testToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token without Bearer got %d", response.StatusCode)
+	}
+}
+
+func TestAPIJoinLeave(t *testing.T) {
+	server := startTestAPI(t)
+	key := strings.Repeat("ab", 16)
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"not json", "{", http.StatusBadRequest},
+		{"no name", `{"key": "` + key + `"}`, http.StatusBadRequest},
+		{"not hex", `{"name": "friends", "key": "zz"}`, http.StatusBadRequest},
+		{"short key", `{"name": "friends", "key": "abcd"}`, http.StatusBadRequest},
+		{"good", `{"name": "friends", "key": "` + key + `"}`, http.StatusOK},
+		{"again", `{"name": "friends", "key": "` + key + `"}`, http.StatusOK},
+	}
+	for _, c := range cases {
+		status, _ := apiRequest(t, server, "POST", "/rooms", c.body, testToken)
+		if status != c.status {
+			t.Errorf("join %s: got %d, expected %d", c.name, status, c.status)
+		}
+	}
+	if rooms := client.Rooms(); len(rooms) != 1 || rooms[0] != "friends" {
+		t.Fatalf("in rooms %v after joining", rooms)
+	}
+
+	if status, _ := apiRequest(t, server, "DELETE", "/rooms/friends", "", testToken); status != http.StatusOK {
+		t.Errorf("leave got %d", status)
+	}
+	if status, _ := apiRequest(t, server, "DELETE", "/rooms/friends", "", testToken); status != http.StatusNotFound {
+		t.Errorf("leaving twice got %d", status)
+	}
+	if rooms := client.Rooms(); len(rooms) != 0 {
+		t.Fatalf("still in rooms %v after leaving", rooms)
+	}
+}
+
+func TestAPIHistoryLimit(t *testing.T) {
+	server := startTestAPI(t)
+	apiRequest(t, server, "POST", "/rooms", `{"name": "friends", "key": "`+strings.Repeat("ab", 16)+`"}`, testToken)
+	for _, text := range []string{"one", "two", "three"} {
+		if status, _ := apiRequest(t, server, "POST", "/rooms/friends/messages", `{"text": "`+text+`"}`, testToken); status != http.StatusOK {
+			t.Fatalf("sending got %d", status)
+		}
+	}
+
+	cases := []struct {
+		limit  string
+		status int
+		want   []string
+	}{
+		{"", http.StatusOK, []string{"one", "two", "three"}},
+		{"?limit=2", http.StatusOK, []string{"two", "three"}},
+		{"?limit=0", http.StatusOK, []string{}},
+		{"?limit=10", http.StatusOK, []string{"one", "two", "three"}},
+		{"?limit=-1", http.StatusBadRequest, nil},
+		{"?limit=two", http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		status, body := apiRequest(t, server, "GET", "/rooms/friends/history"+c.limit, "", testToken)
+		if status != c.status {
+			t.Errorf("%q: got %d, expected %d", c.limit, status, c.status)
+			continue
+		}
+		if c.want == nil {
+			continue
+		}
+		history, _ := body["history"].([]interface{})
+		if len(history) != len(c.want) {
+			t.Errorf("%q: got %v, expected %v", c.limit, history, c.want)
+			continue
+		}
+		for i := range history {
+			if history[i] != c.want[i] {
+				t.Errorf("%q: got %v, expected %v", c.limit, history, c.want)
+				break
+			}
+		}
+	}
+
+	if status, _ := apiRequest(t, server, "GET", "/rooms/strangers/history", "", testToken); status != http.StatusNotFound {
+		t.Errorf("history of a room we are not in got %d", status)
+	}
+}
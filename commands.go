@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jasonfantl/P2PChat/P2Proto"
+)
+
+// commands typed into the message box start with a "/". blocks until the command is done, anything it has to say
+// goes to out, and what went wrong is returned
+func runCommand(input string, out func(string)) error {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "/send":
+		path := strings.TrimSpace(strings.TrimPrefix(input, "/send"))
+		if path == "" {
+			return errors.New("usage: /send <path>")
+		}
+		return client.SendFile(currentRoom(), path)
+	case "/msg":
+		if len(fields) < 3 {
+			return errors.New("usage: /msg <GID> <message>")
+		}
+		return client.SendDirect(currentRoom(), fields[1], strings.Join(fields[2:], " "))
+	case "/members":
+		return findMembers(out)
+	case "/ban":
+		if len(fields) == 1 {
+			listBans(out)
+			return nil
+		}
+		duration := P2Proto.BanDuration
+		if len(fields) > 2 {
+			parsed, err := time.ParseDuration(fields[2])
+			if err != nil {
+				return errors.New("usage: /ban <GID or host> [duration, eg. 1h]")
+			}
+			duration = parsed
+		}
+		P2Proto.Ban(fields[1], duration)
+	case "/unban":
+		if len(fields) != 2 {
+			return errors.New("usage: /unban <GID or host>")
+		}
+		if !P2Proto.Unban(fields[1]) {
+			return errors.New(fields[1] + " was not banned")
+		}
+		out("unbanned " + fields[1])
+	default:
+		return errors.New("unknown command " + fields[0])
+	}
+	return nil
+}
+
+func findMembers(out func(string)) error {
+	members, err := client.FindMembers(currentRoom())
+	if err != nil {
+		return err
+	}
+	out(strconv.Itoa(len(members)) + " other members of " + currentRoom() + " found")
+	for _, member := range members {
+		out("  " + member.GID + " at " + member.Addr)
+	}
+	return nil
+}
+
+func listBans(out func(string)) {
+	bans := P2Proto.Bans()
+	out(strconv.Itoa(len(bans)) + " banned")
+	for who, until := range bans {
+		out("  " + who + " until " + until.Format(time.Stamp))
+	}
+}
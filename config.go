@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// settings come from, in increasing priority: defaults, the config file, P2PCHAT_* environment variables, then flags.
+// the config file is TOML, eg.
+//
+//	listen = ":1234"
+//	bootstrap = ["192.168.1.5:1234", "example.com:1234"]
+//	announce = ["203.0.113.7:1234"]
+//	data_dir = "p2pchat_data"
+//	transport = "quic"
+//	relay = "203.0.113.7:1234"
+//	api = "127.0.0.1:8080"
+//	web = "127.0.0.1:8081"
+//
+//	[ui]
+//	terminal = "tcell"
+//
+//	[[rooms]]
+//	name = "friends"
+//	key = "6368616e676520746869732070617373776f726420746f206120736563726574"
+
+type roomConfig struct {
+	Name string `toml:"name"`
+	Key  string `toml:"key"` // hex AES key, 16, 24 or 32 bytes
+}
+
+// the toml tags are the names in the config file, "-" for settings it cant have
+type config struct {
+	Listen         string       `toml:"listen"`
+	Bootstrap      []string     `toml:"bootstrap"`
+	Announce       []string     `toml:"announce"` // addresses to give out when we are behind a port forward
+	DataDir        string       `toml:"data_dir"` // defaults to p2pchat_data_<port>
+	Identity       string       `toml:"identity"` // defaults to <data dir>/identity
+	Discovery      bool         `toml:"discovery"`
+	Codec          string       `toml:"codec"`
+	Transport      string       `toml:"transport"`        // tcp, or quic to also link with peers over QUIC where they support it
+	Relay          string       `toml:"relay"`            // reachable through this node when behind a NAT
+	RelayForOthers bool         `toml:"relay_for_others"` // act as a relay for others
+	HolePunch      bool         `toml:"hole_punch"`       // try to replace links through a relay with direct ones
+	SimulateNat    bool         `toml:"-"`                // for testing relays, dont accept incoming connections
+	Headless       bool         `toml:"headless"`         // run without the terminal UI, see headless.go
+	LogFile        string       `toml:"log_file"`         // headless logs go here, or stderr if empty
+	Control        string       `toml:"control"`          // headless control socket, defaults to <data dir>/control.sock
+	API            string       `toml:"api"`              // host:port or unix:<path> to serve the local API on, see api.go
+	APIToken       string       `toml:"api_token"`        // file holding the API token, defaults to <data dir>/api_token
+	Web            string       `toml:"web"`              // host:port to serve the web UI on, see web.go
+	Terminal       string       `toml:"-"`                // under [ui] in the file
+	Rooms          []roomConfig `toml:"rooms"`
+}
+
+func defaultConfig() config {
+	return config{
+		Listen:         ":1234",
+		Discovery:      true,
+		Codec:          "cbor",
+		Transport:      "tcp",
+		RelayForOthers: true,
+		HolePunch:      true,
+		Terminal:       tcellTerminal,
+		Rooms: []roomConfig{
+			{Name: "test room", Key: "6368616e676520746869732070617373776f726420746f206120736563726574"},
+			{Name: "test room 2", Key: "6368616e676520746869732070617373776f726420746f206120736563726575"},
+		},
+	}
+}
+
+// the flags buildConfig understands, on flag.CommandLine unless testing
+func defineFlags(flags *flag.FlagSet) {
+	flags.String("config", "", "Path of a config file. Can also be set with P2PCHAT_CONFIG.")
+	flags.String("listen", "", "Address to listen on, host:port or :port. A bare port can also be given as the only argument instead.")
+	flags.String("bootstrap", "", "Comma separated addresses of peers to join the network through, tried in order.")
+	flags.String("announce", "", "Comma separated addresses others can reach this node at, when it is behind a port forward or proxy.")
+	flags.String("data", "", "Directory to keep history, blobs and known peers in.")
+	flags.String("identity", "", "File holding this node's ID, created if missing.")
+	flags.Bool("discovery", true, "Find peers on the local network by UDP multicast.")
+	flags.String("codec", "", "Wire format to send, cbor or gob. Both are always understood.")
+	flags.String("transport", "", "tcp, or quic to also accept QUIC and use it with peers that do.")
+	flags.String("relay", "", "A node to keep a connection with, so others can reach this one through it when behind a NAT.")
+	flags.Bool("relay-for-others", true, "Let nodes behind a NAT be reached through this one.")
+	flags.Bool("hole-punch", true, "When connected to a node through a relay, try to connect to it directly.")
+	flags.Bool("simulate-nat", false, "For testing relays, stop accepting incoming connections once started.")
+	flags.Bool("headless", false, "Run without the terminal UI, logging to stderr and taking commands over a control socket.")
+	flags.String("log-file", "", "When headless, append logs to this file instead of stderr.")
+	flags.String("control", "", "When headless, the unix socket to take commands on.")
+	flags.String("api", "", "Serve the local JSON API on host:port, or unix:<path> for a unix socket.")
+	flags.String("api-token", "", "File holding the token API requests need, created if missing.")
+	flags.String("web", "", "Serve the web UI on host:port, it asks for the API token.")
+	flags.String("terminal", "", "The terminal implementation to use. Available implementations are 'termbox' and 'tcell' (default = tcell).")
+}
+
+func init() {
+	defineFlags(flag.CommandLine)
+}
+
+// parses flags, so must be called before anything else reads them
+func loadConfig() (config, error) {
+	flag.Parse()
+	return buildConfig(flag.CommandLine)
+}
+
+// layers the config file, environment and the flags given in flags over the defaults
+func buildConfig(flags *flag.FlagSet) (config, error) {
+	cfg := defaultConfig()
+
+	path := os.Getenv("P2PCHAT_CONFIG")
+	if configFlag := flags.Lookup("config").Value.String(); configFlag != "" {
+		path = configFlag
+	}
+	if path != "" {
+		err := readConfigFile(path, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	err := applyEnvironment(&cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	// only flags that were given override what we have so far
+	listenGiven := false
+	flags.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		isTrue := value == "true" // bool flags only ever hold true or false
+		switch f.Name {
+		case "listen":
+			cfg.Listen = value
+			listenGiven = true
+		case "bootstrap":
+			cfg.Bootstrap = splitList(value)
+		case "announce":
+			cfg.Announce = splitList(value)
+		case "data":
+			cfg.DataDir = value
+		case "identity":
+			cfg.Identity = value
+		case "discovery":
+			cfg.Discovery = isTrue
+		case "codec":
+			cfg.Codec = value
+		case "transport":
+			cfg.Transport = value
+		case "relay":
+			cfg.Relay = value
+		case "relay-for-others":
+			cfg.RelayForOthers = isTrue
+		case "hole-punch":
+			cfg.HolePunch = isTrue
+		case "simulate-nat":
+			cfg.SimulateNat = isTrue
+		case "headless":
+			cfg.Headless = isTrue
+		case "log-file":
+			cfg.LogFile = value
+		case "control":
+			cfg.Control = value
+		case "api":
+			cfg.API = value
+		case "api-token":
+			cfg.APIToken = value
+		case "web":
+			cfg.Web = value
+		case "terminal":
+			cfg.Terminal = value
+		}
+	})
+
+	switch { // the old way of giving the port, the same as -listen :port
+	case flags.NArg() > 1:
+		return cfg, errors.New("expected at most one argument, the port to listen on, got " + strings.Join(flags.Args(), " "))
+	case flags.NArg() == 1 && listenGiven:
+		return cfg, errors.New("give either -listen or a port, not both")
+	case flags.NArg() == 1:
+		cfg.Listen = ":" + flags.Arg(0)
+	}
+
+	return cfg, cfg.validate()
+}
+
+func applyEnvironment(cfg *config) error {
+	if value, ok := os.LookupEnv("P2PCHAT_LISTEN"); ok {
+		cfg.Listen = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_BOOTSTRAP"); ok {
+		cfg.Bootstrap = splitList(value)
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_ANNOUNCE"); ok {
+		cfg.Announce = splitList(value)
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_DATA_DIR"); ok {
+		cfg.DataDir = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_IDENTITY"); ok {
+		cfg.Identity = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_DISCOVERY"); ok {
+		discovery, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("P2PCHAT_DISCOVERY: expected true or false, got " + strconv.Quote(value))
+		}
+		cfg.Discovery = discovery
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_CODEC"); ok {
+		cfg.Codec = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_TRANSPORT"); ok {
+		cfg.Transport = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_RELAY"); ok {
+		cfg.Relay = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_RELAY_FOR_OTHERS"); ok {
+		relayForOthers, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("P2PCHAT_RELAY_FOR_OTHERS: expected true or false, got " + strconv.Quote(value))
+		}
+		cfg.RelayForOthers = relayForOthers
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_HOLE_PUNCH"); ok {
+		holePunch, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("P2PCHAT_HOLE_PUNCH: expected true or false, got " + strconv.Quote(value))
+		}
+		cfg.HolePunch = holePunch
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_HEADLESS"); ok {
+		headless, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("P2PCHAT_HEADLESS: expected true or false, got " + strconv.Quote(value))
+		}
+		cfg.Headless = headless
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_LOG_FILE"); ok {
+		cfg.LogFile = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_CONTROL"); ok {
+		cfg.Control = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_API"); ok {
+		cfg.API = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_API_TOKEN"); ok {
+		cfg.APIToken = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_WEB"); ok {
+		cfg.Web = value
+	}
+	if value, ok := os.LookupEnv("P2PCHAT_TERMINAL"); ok {
+		cfg.Terminal = value
+	}
+	return nil
+}
+
+// addresses separated by commas or spaces
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// an address typed to connect to, host:port, [IPv6]:port, or a host alone to use the default port
+func connectAddress(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err == nil {
+		if host == "" || port == "" {
+			return "", errors.New(strconv.Quote(s) + " must be host:port")
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+
+	host = s
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	// a colon is only fine in a bare IPv6 address, otherwise it is a malformed host:port
+	if host == "" || (strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+		return "", errors.New(strconv.Quote(s) + " is not an address, use host:port or [IPv6]:port")
+	}
+	return net.JoinHostPort(host, defaultConfig().port()), nil
+}
+
+// the port we listen on, used to keep the data of several nodes on one machine apart
+func (cfg config) port() string {
+	_, port, _ := net.SplitHostPort(cfg.Listen)
+	return port
+}
+
+// reports every problem at once, so they can all be fixed before trying again
+func (cfg config) validate() error {
+	problems := make([]string, 0)
+
+	if _, err := net.ResolveTCPAddr("tcp", cfg.Listen); err != nil {
+		problems = append(problems, "listen address "+strconv.Quote(cfg.Listen)+": "+err.Error())
+	}
+	for _, addr := range cfg.Bootstrap {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" || port == "" {
+			problems = append(problems, "bootstrap address "+strconv.Quote(addr)+" must be host:port")
+		}
+	}
+	for _, addr := range cfg.Announce {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" || port == "" {
+			problems = append(problems, "announce address "+strconv.Quote(addr)+" must be host:port")
+		}
+	}
+	if cfg.Codec != "cbor" && cfg.Codec != "gob" {
+		problems = append(problems, "codec "+strconv.Quote(cfg.Codec)+" must be cbor or gob")
+	}
+	if cfg.Relay != "" {
+		host, port, err := net.SplitHostPort(cfg.Relay)
+		if err != nil || host == "" || port == "" {
+			problems = append(problems, "relay address "+strconv.Quote(cfg.Relay)+" must be host:port")
+		}
+	}
+	if path, isUnix := strings.CutPrefix(cfg.API, "unix:"); isUnix && path == "" {
+		problems = append(problems, "api needs a path after unix:")
+	} else if cfg.API != "" && !isUnix {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.API); err != nil {
+			problems = append(problems, "api address "+strconv.Quote(cfg.API)+": "+err.Error())
+		}
+	}
+	if cfg.Web != "" {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.Web); err != nil {
+			problems = append(problems, "web address "+strconv.Quote(cfg.Web)+": "+err.Error())
+		}
+	}
+	if cfg.Transport != "tcp" && cfg.Transport != "quic" {
+		problems = append(problems, "transport "+strconv.Quote(cfg.Transport)+" must be tcp or quic")
+	}
+	if cfg.Terminal != tcellTerminal && cfg.Terminal != termboxTerminal {
+		problems = append(problems, "terminal "+strconv.Quote(cfg.Terminal)+" must be tcell or termbox")
+	}
+
+	names := make(map[string]bool)
+	for i, room := range cfg.Rooms {
+		if room.Name == "" {
+			problems = append(problems, "room "+strconv.Itoa(i+1)+" has no name")
+		} else if names[room.Name] {
+			problems = append(problems, "room "+strconv.Quote(room.Name)+" is listed twice")
+		}
+		names[room.Name] = true
+
+		key, err := hex.DecodeString(room.Key)
+		if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+			problems = append(problems, "room "+strconv.Quote(room.Name)+" needs a key of 32, 48 or 64 hex characters")
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
+
+// the config file's layout, config with the terminal under [ui]
+type configFile struct {
+	config
+	UI struct {
+		Terminal string `toml:"terminal"`
+	} `toml:"ui"`
+}
+
+// settings in the file replace what cfg has, rooms in it replace the default ones
+func readConfigFile(path string, cfg *config) error {
+	file := configFile{config: *cfg}
+	file.UI.Terminal = cfg.Terminal
+	meta, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		unknown := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			unknown = append(unknown, key.String())
+		}
+		return errors.New(path + ": unknown setting " + strings.Join(unknown, ", "))
+	}
+
+	*cfg = file.config
+	cfg.Terminal = file.UI.Terminal
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "p2pchat.toml")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+# a comment
+listen = ":4321"   # trailing comment
+bootstrap = [
+	"192.168.1.5:1234", # over several lines
+	'[::1]:1234',
+]
+discovery = false
+relay = '203.0.113.7:1234'
+data_dir = 'C:\Users\me\p2pchat'
+
+[ui]
+terminal = "termbox"
+
+[[rooms]]
+name = "friends # not a comment"
+key = "6368616e676520746869732070617373776f726420746f206120736563726574"
+
+[[rooms]]
+name = "work"
+key = "00112233445566778899aabbccddeeff"
+`)
+
+	cfg := defaultConfig()
+	err := readConfigFile(path, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	want.Listen = ":4321"
+	want.Bootstrap = []string{"192.168.1.5:1234", "[::1]:1234"}
+	want.Discovery = false
+	want.Relay = "203.0.113.7:1234"
+	want.DataDir = `C:\Users\me\p2pchat`
+	want.Terminal = termboxTerminal
+	want.Rooms = []roomConfig{
+		{Name: "friends # not a comment", Key: "6368616e676520746869732070617373776f726420746f206120736563726574"},
+		{Name: "work", Key: "00112233445566778899aabbccddeeff"},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("read %+v\nexpected %+v", cfg, want)
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		contents string
+		err      string
+	}{
+		{contents: "listen :1234", err: "line 1"},
+		{contents: "\nlisten = 1234", err: "line 2"},
+		{contents: `listen = "unterminated`, err: "line 1"},
+		{contents: `colour = "blue"`, err: "unknown setting colour"},
+		{contents: "[ui]\nlisten = \":1\"", err: "unknown setting ui.listen"},
+		{contents: "[network]", err: "unknown setting network"},
+		{contents: `simulate_nat = true`, err: "unknown setting simulate_nat"},
+		{contents: `discovery = "yes"`, err: "discovery"},
+		{contents: `listen = true`, err: "listen"},
+		{contents: `bootstrap = "a:1"`, err: "bootstrap"},
+		{contents: `name = "outside rooms"`, err: "unknown setting name"},
+	}
+
+	for _, test := range tests {
+		cfg := defaultConfig()
+		err := readConfigFile(writeConfigFile(t, test.contents), &cfg)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("reading %q gave error %v, expected %q", test.contents, err, test.err)
+		}
+	}
+}
+
+func testConfig(t *testing.T, args ...string) (config, error) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	defineFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return buildConfig(flags)
+}
+
+// file < environment < flags
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+listen = ":1111"
+codec = "gob"
+transport = "quic"
+discovery = false
+`)
+	t.Setenv("P2PCHAT_CONFIG", path)
+	t.Setenv("P2PCHAT_CODEC", "cbor")
+	t.Setenv("P2PCHAT_TRANSPORT", "tcp")
+
+	cfg, err := testConfig(t, "-transport", "quic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":1111" {
+		t.Errorf("listen %q, expected the file's :1111", cfg.Listen)
+	}
+	if cfg.Discovery {
+		t.Errorf("discovery on, the file turned it off")
+	}
+	if cfg.Codec != "cbor" {
+		t.Errorf("codec %q, expected the environment's cbor", cfg.Codec)
+	}
+	if cfg.Transport != "quic" {
+		t.Errorf("transport %q, expected the flag's quic", cfg.Transport)
+	}
+
+	cfg, err = testConfig(t, "-discovery=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Discovery {
+		t.Errorf("discovery off, the flag turned it on")
+	}
+}
+
+func TestConfigFlagOverridesEnvironmentPath(t *testing.T) {
+	t.Setenv("P2PCHAT_CONFIG", writeConfigFile(t, `listen = ":1111"`))
+	cfg, err := testConfig(t, "-config", writeConfigFile(t, `listen = ":2222"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":2222" {
+		t.Errorf("listen %q, expected :2222 from the -config file", cfg.Listen)
+	}
+}
+
+func TestListenPort(t *testing.T) {
+	t.Setenv("P2PCHAT_LISTEN", ":1111")
+
+	cfg, err := testConfig(t, "2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":2222" {
+		t.Errorf("listen %q, the port argument should override the environment", cfg.Listen)
+	}
+
+	if _, err := testConfig(t, "-listen", ":3333", "2222"); err == nil {
+		t.Errorf("accepted both -listen and a port")
+	}
+	if _, err := testConfig(t, "2222", "3333"); err == nil {
+		t.Errorf("accepted two ports")
+	}
+}
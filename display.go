@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"flag"
 	"log"
 	"sort"
 	"strconv"
@@ -49,11 +48,7 @@ func ConnectInput() (*textinput.TextInput, error) {
 		textinput.Label("Connect: ", cell.FgColor(cell.ColorCyan)),
 		textinput.FillColor(cell.ColorGray),
 		textinput.OnSubmit(func(text string) error {
-			if text == "" {
-				P2Proto.EnterNetwork("127.0.0.1:1234")
-			} else {
-				P2Proto.EnterNetwork(text)
-			}
+			connectTo(text)
 			return nil
 		}),
 		textinput.ClearOnSubmit(),
@@ -64,6 +59,28 @@ func ConnectInput() (*textinput.TextInput, error) {
 	return input, err
 }
 
+// what the connect box submits, also used by the web UI
+func connectTo(text string) {
+	if text == "" {
+		go P2Proto.Bootstrap([]string{"127.0.0.1:1234"})
+		return
+	}
+
+	// several addresses can be given, separated by commas or spaces
+	addrs := make([]string, 0)
+	for _, field := range splitList(text) {
+		addr, err := connectAddress(field)
+		if err != nil {
+			logger(err.Error())
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) > 0 {
+		go P2Proto.Bootstrap(addrs)
+	}
+}
+
 func newWrappedRollingText() (*text.Text, error) {
 	t, err := text.New(text.RollContent(), text.WrapAtWords())
 	if err != nil {
@@ -75,6 +92,7 @@ func newWrappedRollingText() (*text.Text, error) {
 
 var chatID = "chatID"
 var messageTextID = "messagesID"
+var debugID = "debugID"
 
 func newChatroomButton(name string) (*button.Button, error) {
 	opts := []button.Option{
@@ -85,7 +103,7 @@ func newChatroomButton(name string) (*button.Button, error) {
 	}
 
 	newButton, err := button.New(name, func() error {
-		currentRoomName = name
+		setCurrentRoom(name)
 		return c.Update(messageTextID, generateMessageLayout()...)
 	}, opts...)
 	if err != nil {
@@ -104,31 +122,88 @@ func WriteLn(t *text.Text, text string) {
 
 func displayPeers(peers P2Proto.PeerList) {
 	peersList.Reset()
+	for _, line := range peerLines(peers) {
+		WriteLn(peersList, line)
+	}
+}
 
+// one line for each peer, sorted
+func peerLines(peers P2Proto.PeerList) []string {
 	var ips []string
 	for peer := range peers {
-		ips = append(ips, peer.Meta.GID+" "+strconv.Itoa(peer.Meta.ConnectionCount))
+		stats := peer.Stats()
+		line := shortGID(peer.Meta.GID)
+		if peer.Meta.ListenAddr != "" {
+			line += " at " + peer.Meta.ListenAddr
+		}
+		line += " " + strconv.Itoa(peer.Meta.ConnectionCount) +
+			" rx " + strconv.FormatInt(stats.Packets, 10) + "/" + strconv.FormatInt(stats.Bytes/1024, 10) + "KB"
+		if stats.Throttled > 0 {
+			line += " throttled " + strconv.FormatInt(stats.Throttled, 10)
+		}
+		if stats.Queued > 0 || stats.SendDropped > 0 {
+			line += " tx queue " + strconv.Itoa(stats.Queued) + " dropped " + strconv.FormatInt(stats.SendDropped, 10)
+		}
+		ips = append(ips, line)
 	}
 	sort.Strings(ips)
+	return ips
+}
 
-	for _, ip := range ips {
-		WriteLn(peersList, ip)
+// GIDs are long, the start is enough to tell peers apart
+func shortGID(gid string) string {
+	if len(gid) > 12 {
+		return gid[:12]
+	}
+	return gid
+}
+
+func generateDebugLayout() []container.Option {
+	options := []container.Option{
+		container.PlaceWidget(errorMessages),
+		container.Border(linestyle.Double),
+		container.BorderColor(cell.ColorMaroon),
+		container.ID(debugID),
+	}
+
+	if title := compressionSummary(); title != "" {
+		options = append(options, container.BorderTitle(title))
+	}
+	return options
+}
+
+// empty until something was compressed
+func compressionSummary() string {
+	stats := P2Proto.Compression()
+	if stats.Frames == 0 {
+		return ""
+	}
+	saved := stats.Before - stats.After
+	return "compression saved " + strconv.FormatInt(saved/1024, 10) + "KB (" +
+		strconv.FormatInt(saved*100/stats.Before, 10) + "%) over " + strconv.FormatInt(stats.Frames, 10) + " frames"
+}
+
+// the debug pane's title shows traffic stats, which change without anything else being redrawn
+func updateDebugLoop() {
+	for {
+		time.Sleep(5 * time.Second)
+		c.Update(debugID, generateDebugLayout()...)
 	}
 }
 
 func generateMessageLayout() []container.Option {
 
-	chatroom, ok := chatrooms[currentRoomName]
-	if ok {
-		messageText.Reset()
-		for _, h := range chatroom.history {
+	history, err := client.History(currentRoom())
+	messageText.Reset()
+	if err == nil {
+		for _, h := range history {
 			WriteLn(messageText, h)
 		}
 	}
 
 	return []container.Option{
 		container.Border(linestyle.Light),
-		container.BorderTitle(currentRoomName),
+		container.BorderTitle(currentRoom()),
 		container.PlaceWidget(messageText),
 		container.ID(messageTextID),
 	}
@@ -138,13 +213,7 @@ func generateChatLayout() []container.Option {
 
 	layout := []container.Option{}
 
-	keys := make([]string, 0)
-	for k, _ := range chatrooms {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	for _, name := range keys {
+	for _, name := range client.Rooms() {
 		b, err := newChatroomButton(name)
 		if err != nil {
 			continue
@@ -211,11 +280,7 @@ func contLayout() ([]container.Option, error) {
 	debuggingLayout := []container.Option{
 		container.SplitVertical(
 			container.Left(peersLayout...),
-			container.Right(
-				container.PlaceWidget(errorMessages),
-				container.Border(linestyle.Double),
-				container.BorderColor(cell.ColorMaroon),
-			),
+			container.Right(generateDebugLayout()...),
 			container.SplitPercent(30),
 		),
 	}
@@ -240,13 +305,9 @@ var displayTerminal terminalapi.Terminal
 var terminalCancel context.CancelFunc
 var ctx context.Context
 
-func setupDisplay() {
-	terminalPtr := flag.String("terminal",
-		"tcell",
-		"The terminal implementation to use. Available implementations are 'termbox' and 'tcell' (default = tcell).")
-
+func setupDisplay(terminal string) {
 	var err error
-	switch terminal := *terminalPtr; terminal {
+	switch terminal {
 	case termboxTerminal:
 		displayTerminal, err = termbox.New(termbox.ColorMode(terminalapi.ColorMode256))
 	case tcellTerminal:
@@ -304,6 +365,7 @@ func setupDisplay() {
 			panic(err)
 		}
 	}()
+	go updateDebugLoop()
 }
 
 func closeDisplay() {
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/jasonfantl/P2PChat/P2Proto"
+)
+
+// running without the terminal UI, for a node on a server or in CI that is mostly there to relay and bootstrap
+// others. logs are written as JSON lines, and the node takes commands over a unix socket, one per line:
+//
+//	echo /peers | nc -U p2pchat_data_1234/control.sock
+//
+// anything not starting with a "/" is sent to the current room, like typing it into the message box. the commands
+// of the message box work too. each command is answered with its output, or "ok" if it has none, or "error: ..."
+
+var headless = false
+var headlessLog *slog.Logger
+
+// starts logging and the control socket, the returned func cleans up after them
+func setupHeadless(cfg config) (func(), error) {
+	headless = true
+
+	out := io.Writer(os.Stderr)
+	var logFile *os.File
+	if cfg.LogFile != "" {
+		var err error
+		logFile, err = os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		out = logFile
+	}
+	headlessLog = slog.New(slog.NewJSONHandler(out, nil))
+
+	path := cfg.Control
+	if path == "" {
+		path = filepath.Join(dataDir, "control.sock")
+	}
+	listener, err := listenUnix(path)
+	if err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		return nil, err
+	}
+	headlessLog.Info("taking commands on " + path)
+	go acceptControl(listener)
+
+	// stop cleanly when the service manager or ctrl-c tells us to
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		quit <- true
+	}()
+
+	return func() {
+		listener.Close() // also removes the socket file
+		if logFile != nil {
+			logFile.Close()
+		}
+	}, nil
+}
+
+// only we can use the socket
+func listenUnix(path string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// a socket left behind by a node that didnt shut down cleanly, unless that node is still running
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New(path + " is in use, is another node running with the same data directory?")
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0600) // anyone who can write to it can speak for us
+	return listener, nil
+}
+
+func acceptControl(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handleControl(conn)
+	}
+}
+
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		for _, reply := range controlCommand(line) {
+			_, err := io.WriteString(conn, reply+"\n")
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// runs a line from the control socket, returning what to answer with
+func controlCommand(line string) []string {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "/peers":
+		peersLock.Lock()
+		defer peersLock.Unlock()
+		return append([]string{}, peerLineSnapshot...)
+	case "/rooms":
+		names := client.Rooms()
+		for i, name := range names {
+			if name == currentRoom() {
+				names[i] += " (current)"
+			}
+		}
+		return names
+	case "/room":
+		name := strings.TrimSpace(strings.TrimPrefix(line, "/room"))
+		if _, err := client.History(name); err != nil {
+			return []string{"error: " + err.Error()}
+		}
+		setCurrentRoom(name)
+		return []string{"ok"}
+	case "/join":
+		if len(fields) < 3 {
+			return []string{"usage: /join <name> <hex key>"}
+		}
+		name := strings.Join(fields[1:len(fields)-1], " ")
+		key, err := hex.DecodeString(fields[len(fields)-1])
+		if err == nil {
+			err = client.JoinRoom(name, key)
+		}
+		if err != nil {
+			return []string{"error: the key must be 32, 48 or 64 hex characters"}
+		}
+		return []string{"ok"}
+	case "/leave":
+		name := strings.TrimSpace(strings.TrimPrefix(line, "/leave"))
+		if err := client.LeaveRoom(name); err != nil {
+			return []string{"error: " + err.Error()}
+		}
+		return []string{"ok"}
+	case "/connect":
+		addrs := make([]string, 0)
+		for _, field := range fields[1:] {
+			addr, err := connectAddress(field)
+			if err != nil {
+				return []string{"error: " + err.Error()}
+			}
+			addrs = append(addrs, addr)
+		}
+		if len(addrs) == 0 {
+			return []string{"usage: /connect <address> [address...]"}
+		}
+		go P2Proto.Bootstrap(addrs)
+		return []string{"ok"}
+	case "/quit":
+		go func() { quit <- true }() // after we answer
+		return []string{"ok"}
+	}
+
+	if !strings.HasPrefix(line, "/") {
+		if err := client.Send(currentRoom(), line); err != nil {
+			return []string{"error: " + err.Error() + ", pick a room with /room <name>"}
+		}
+		return []string{"ok"}
+	}
+	output := make([]string, 0)
+	err := runCommand(line, func(s string) {
+		output = append(output, s)
+	})
+	if err != nil {
+		output = append(output, "error: "+err.Error())
+	} else if len(output) == 0 {
+		output = append(output, "ok")
+	}
+	return output
+}
+
+// event is empty for plain log lines, errors are logged at error level
+func logHeadless(event string, s string, attrs ...string) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return
+	}
+	args := make([]any, 0, len(attrs)+2)
+	if event != "" {
+		args = append(args, "event", event)
+	}
+	for _, attr := range attrs {
+		args = append(args, attr)
+	}
+	level := slog.LevelInfo
+	if event == "error" {
+		level = slog.LevelError
+	}
+	headlessLog.Log(context.Background(), level, s, args...)
+}
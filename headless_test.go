@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestHeadlessLogFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	headlessLog = slog.New(slog.NewJSONHandler(buf, nil))
+
+	logHeadless("error", "dropping 192.0.2.1:1234, could not read: EOF\n", "peer", "abc", "addr", "192.0.2.1:1234", "error", "EOF")
+	logHeadless("", "   ")
+
+	line := map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("not one JSON line: %q", buf.String())
+	}
+	want := map[string]string{
+		"level": "ERROR",
+		"msg":   "dropping 192.0.2.1:1234, could not read: EOF",
+		"event": "error",
+		"peer":  "abc",
+		"addr":  "192.0.2.1:1234",
+		"error": "EOF",
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s is %q, expected %q", key, line[key], value)
+		}
+	}
+}
@@ -1,109 +1,191 @@
 package main
 
 import (
-	"encoding/gob"
 	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/jasonfantl/P2PChat/Chat"
 	"github.com/jasonfantl/P2PChat/P2Proto"
 )
 
 var quit chan bool
 
-type chatroom struct {
-	name    string
-	key     []byte
-	history []string
-}
+var client *Chat.Client
+var dataDir string
 
-var chatrooms map[string]*chatroom
+// the room selected in the UI, read by the API and control socket too
+var currentRoomLock sync.Mutex
 var currentRoomName string
 
+func currentRoom() string {
+	currentRoomLock.Lock()
+	defer currentRoomLock.Unlock()
+	return currentRoomName
+}
+
+func setCurrentRoom(name string) {
+	currentRoomLock.Lock()
+	currentRoomName = name
+	currentRoomLock.Unlock()
+}
+
 // func createChatRoom(name string) {
 // 	key := make([]byte, 32) //generate a random 32 byte key for AES-256
 // 	if _, err := rand.Read(key); err != nil {
 // 		panic(err.Error())
 // 	}
 
-// 	addChatRoom(name, key)
+// 	client.JoinRoom(name, key)
 // }
 
-func addChatRoom(name string, key []byte) {
-	if _, exist := chatrooms[name]; exist {
-		return
+// what the message box submits
+func sendMessage(plaintext string) error {
+	if strings.HasPrefix(plaintext, "/") {
+		go func() { // some wait on the network
+			if err := runCommand(plaintext, logger); err != nil {
+				logger(err.Error())
+			}
+		}()
+		return nil
 	}
 
-	chatrooms[name] = &chatroom{
-		name:    name,
-		key:     key,
-		history: make([]string, 0),
+	err := client.Send(currentRoom(), plaintext)
+	if err != nil {
+		logger(err.Error())
 	}
-
-	// update display
-	c.Update(chatID, generateChatLayout()...)
+	return nil
 }
 
-type Message []byte
-
-func recievePacket(packet P2Proto.Packet) {
-	if packet.Type == P2Proto.MESSAGE {
-		message := packet.Payload.(Message)
-
-		for _, chatroom := range chatrooms {
-			decrypted, ok := decrypt(message, chatroom.key)
-			if !ok {
-				continue
+// shows what the client tells us about, wherever we show things
+func handleChatEvents() {
+	for event := range client.Events() {
+		switch event.Type {
+		case Chat.MessageEvent:
+			publishEvent("message", apiMessage{Room: event.Room, Text: event.Line})
+			if headless {
+				headlessLog.Info("message", "room", event.Room, "text", event.Line)
+			} else if event.Room == currentRoom() {
+				WriteLn(messageText, event.Line)
 			}
-
-			plaintext := string(decrypted)
-
-			text := packet.Origin + ": " + plaintext
-
-			if currentRoomName == chatroom.name {
-				WriteLn(messageText, text)
+		case Chat.RoomJoined, Chat.RoomLeft:
+			if event.Type == Chat.RoomLeft {
+				currentRoomLock.Lock()
+				if event.Room == currentRoomName {
+					currentRoomName = ""
+				}
+				currentRoomLock.Unlock()
+			}
+			publishEvent("rooms", client.Rooms())
+			if !headless {
+				c.Update(chatID, generateChatLayout()...)
+				c.Update(messageTextID, generateMessageLayout()...)
 			}
-			chatroom.history = append(chatroom.history, text)
-
 		}
 	}
 }
 
-func sendMessage(plaintext string) error {
-
-	chatroom, ok := chatrooms[currentRoomName]
-	if !ok {
-		logger("invalid chatroom")
-		return nil
+func main() {
+	// usage: P2PChat [flags] [port], see config.go
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	WriteLn(messageText, plaintext)
-	chatroom.history = append(chatroom.history, plaintext)
-
-	encrypted := Message(encrypt([]byte(plaintext), chatroom.key))
-
-	P2Proto.SendMessage(encrypted)
-	return nil
-}
+	P2Proto.ListenAddress = cfg.Listen
+	P2Proto.BootstrapAddrs = cfg.Bootstrap
+	P2Proto.AnnounceAddrs = cfg.Announce
+	P2Proto.DiscoveryEnabled = cfg.Discovery
+	P2Proto.QuicEnabled = cfg.Transport == "quic"
+	P2Proto.RelayAddr = cfg.Relay
+	P2Proto.RelayService = cfg.RelayForOthers
+	P2Proto.HolePunching = cfg.HolePunch
+	P2Proto.SimulateNat = cfg.SimulateNat
+	if cfg.Codec == "gob" {
+		P2Proto.WireCodec = P2Proto.GobCodec{}
+	}
 
-func main() {
-	gob.Register(Message{})
+	// keep each node's files apart so several can run on one machine
+	dataDir = cfg.DataDir
+	if dataDir == "" {
+		dataDir = "p2pchat_data_" + cfg.port()
+	}
+	P2Proto.BlobDir = filepath.Join(dataDir, "blobs")
+	P2Proto.AddressBookPath = filepath.Join(dataDir, "addresses.json")
+	P2Proto.BanListPath = filepath.Join(dataDir, "bans.json")
+	P2Proto.IdentityPath = cfg.Identity
+	if P2Proto.IdentityPath == "" {
+		P2Proto.IdentityPath = filepath.Join(dataDir, "identity")
+	}
 
 	quit = make(chan bool)
-	chatrooms = make(map[string]*chatroom)
+	client = Chat.NewClient(dataDir, logger)
+	P2Proto.LogEvent = logEvent
+
+	if cfg.Headless {
+		closeHeadless, err := setupHeadless(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer closeHeadless()
+	} else {
+		setupDisplay(cfg.Terminal)
+		defer closeDisplay()
+	}
+	go handleChatEvents()
 
-	setupDisplay()
-	defer closeDisplay()
+	for _, room := range cfg.Rooms {
+		key, _ := hex.DecodeString(room.Key) // checked by validate
+		client.JoinRoom(room.Name, key)
+	}
 
-	key, _ := hex.DecodeString("6368616e676520746869732070617373776f726420746f206120736563726574")
-	addChatRoom("test room", key)
+	if headless && len(cfg.Rooms) > 0 { // nobody to click a room button
+		setCurrentRoom(cfg.Rooms[0].Name)
+	}
 
-	key2, _ := hex.DecodeString("6368616e676520746869732070617373776f726420746f206120736563726575")
-	addChatRoom("test room 2", key2)
+	if cfg.API != "" || cfg.Web != "" {
+		tokenPath := cfg.APIToken
+		if tokenPath == "" {
+			tokenPath = filepath.Join(dataDir, "api_token")
+		}
+		token, err := loadAPIToken(tokenPath)
+		if err != nil {
+			logger("not serving the API or web UI: " + err.Error())
+		} else {
+			logger("the API and web UI need the token in " + tokenPath)
+		}
+
+		if err == nil && cfg.API != "" {
+			closeAPI, err := setupAPI(cfg.API, token)
+			if err != nil {
+				logger("not serving the API: " + err.Error())
+			} else {
+				defer closeAPI()
+			}
+		}
+		if err == nil && cfg.Web != "" {
+			closeWeb, err := setupWeb(cfg.Web, token)
+			if err != nil {
+				logger("not serving the web UI: " + err.Error())
+			} else {
+				defer closeWeb()
+			}
+		}
+	}
 
 	updatePeers := func(peers P2Proto.PeerList) {
-		displayPeers(peers)
+		rememberPeers(peers)
+		if !headless {
+			displayPeers(peers)
+		}
 	}
 
-	go P2Proto.Setup(recievePacket, updatePeers, logger)
+	go client.Start(updatePeers)
 
 	for {
 		select {
@@ -114,5 +196,16 @@ func main() {
 }
 
 func logger(s string) {
+	logEvent("", s)
+}
+
+// attrs are key value pairs, only kept apart in the headless JSON logs
+func logEvent(event string, s string, attrs ...string) {
+	rememberLog(strings.TrimSpace(s))
+	publishEvent("log", strings.TrimSpace(s))
+	if headless {
+		logHeadless(event, s, attrs...)
+		return
+	}
 	WriteLn(errorMessages, s)
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// a web UI for those who would rather not use the terminal, laid out like display.go. the page in web/ is built in,
+// and talks to the node over a WebSocket at /ws. the page asks for the API token and keeps it in the browser's
+// storage, never in a URL. browsers cant set headers on a WebSocket, so it is offered as the subprotocol
+// "bearer.<token>" next to "p2pchat", or can be sent as "Authorization: Bearer <token>" by anything else.
+// the node sends {"type": ..., "data": ...}:
+//
+//	rooms     names of the rooms we are in
+//	history   {"room": ..., "lines": [...]}, answering a history request
+//	message   {"room": ..., "text": ...}, a line added to a room's history
+//	peers     the same as the API's /peers
+//	log       a line for the debug pane
+//	stats     the debug pane's title
+//
+// and the page sends {"type": "history", "room": ...}, {"type": "send", "room": ..., "text": ...} or
+// {"type": "connect", "text": <addresses>}
+//
+// requests from pages on other origins are refused, so another site open in the browser cant use the node
+
+//go:embed web
+var webFiles embed.FS
+
+// how many log lines a newly opened page starts with
+const webLogLines = 200
+
+// the subprotocol the page speaks, and the prefix of the one carrying its token
+const webProtocol = "p2pchat"
+const webTokenProtocol = "bearer."
+
+var recentLogs []string
+var recentLogsLock sync.Mutex
+
+type webMessage struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type webRequest struct {
+	Type string `json:"type"`
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+type webHistory struct {
+	Room  string   `json:"room"`
+	Lines []string `json:"lines"`
+}
+
+// starts serving the web UI on addr, the returned func stops it
+func setupWeb(addr string, token string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: webHandler(token)}
+	go server.Serve(listener)
+	logger("web UI on http://" + listener.Addr().String() + "/")
+
+	return func() {
+		server.Close()
+	}, nil
+}
+
+func webHandler(token string) http.Handler {
+	static, _ := fs.Sub(webFiles, "web") // web is always there, it is built in
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServer(http.FS(static)))
+	mux.Handle("GET /ws", tokenFromProtocol(requireToken(token, http.HandlerFunc(serveWebSocket))))
+	return sameOrigin(mux)
+}
+
+// browsers send Origin with cross-origin requests and WebSocket upgrades, so one naming another host is refused
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			parsed, err := url.Parse(origin)
+			if err != nil || parsed.Host != r.Host {
+				writeError(w, http.StatusForbidden, "cross-origin requests are not allowed")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// moves a token offered as a subprotocol to the Authorization header, for requireToken
+func tokenFromProtocol(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+				if given, ok := strings.CutPrefix(strings.TrimSpace(protocol), webTokenProtocol); ok {
+					r.Header.Set("Authorization", "Bearer "+given)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	// sameOrigin has checked the origin already, Accept checks it again
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{webProtocol}})
+	if err != nil {
+		return // Accept has answered them
+	}
+	defer ws.CloseNow()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	send := func(kind string, data interface{}) error {
+		writeCtx, cancelWrite := context.WithTimeout(ctx, 10*time.Second)
+		defer cancelWrite()
+		return wsjson.Write(writeCtx, ws, webMessage{Type: kind, Data: data})
+	}
+
+	events := subscribeEvents()
+	defer unsubscribeEvents(events)
+
+	// what the panes start with
+	send("rooms", client.Rooms())
+	peersLock.Lock()
+	peers := append([]apiPeer{}, peerSnapshot...)
+	peersLock.Unlock()
+	send("peers", peers)
+	recentLogsLock.Lock()
+	logs := append([]string{}, recentLogs...)
+	recentLogsLock.Unlock()
+	for _, line := range logs {
+		send("log", line)
+	}
+	send("stats", compressionSummary())
+
+	go func() {
+		stats := time.NewTicker(5 * time.Second)
+		defer stats.Stop()
+		for {
+			var err error
+			select {
+			case event := <-events:
+				err = send(event.Kind, event.Data)
+			case <-stats.C:
+				err = send("stats", compressionSummary())
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				cancel() // stops the reads below too
+				return
+			}
+		}
+	}()
+
+	for {
+		request := webRequest{}
+		err := wsjson.Read(ctx, ws, &request)
+		if err != nil {
+			return
+		}
+
+		switch request.Type {
+		case "history":
+			lines, err := client.History(request.Room)
+			if err != nil {
+				lines = []string{}
+			}
+			send("history", webHistory{Room: request.Room, Lines: lines})
+		case "send":
+			if strings.HasPrefix(request.Text, "/") {
+				send("log", "commands only work in the terminal or over the control socket")
+				continue
+			}
+			err := client.Send(request.Room, request.Text)
+			if err != nil {
+				send("log", err.Error())
+			}
+		case "connect":
+			connectTo(request.Text)
+		}
+	}
+}
+
+func rememberLog(line string) {
+	if line == "" {
+		return
+	}
+	recentLogsLock.Lock()
+	recentLogs = append(recentLogs, line)
+	if len(recentLogs) > webLogLines {
+		recentLogs = recentLogs[len(recentLogs)-webLogLines:]
+	}
+	recentLogsLock.Unlock()
+}
@@ -0,0 +1,140 @@
+// talks to the node over /ws, see web.go for what is sent each way
+
+// asked for once and remembered, it is never put in a URL
+var token = localStorage.getItem("p2pchat-token");
+if (!token) {
+	token = prompt("API token, from api_token in the node's data directory") || "";
+}
+localStorage.setItem("p2pchat-token", token);
+
+var currentRoom = "";
+var maxLogLines = 500;
+
+var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+// a WebSocket cant have headers, so the token goes as a subprotocol
+var socket = new WebSocket(scheme + location.host + "/ws", ["p2pchat", "bearer." + token]);
+
+socket.onmessage = function (event) {
+	var message = JSON.parse(event.data);
+	var data = message.data;
+	switch (message.type) {
+	case "rooms":
+		showRooms(data);
+		break;
+	case "history":
+		if (data.room === currentRoom) {
+			document.getElementById("messages").textContent = "";
+			data.lines.forEach(function (line) { writeLine("messages", line); });
+		}
+		break;
+	case "message":
+		if (data.room === currentRoom) {
+			writeLine("messages", data.text);
+		}
+		break;
+	case "peers":
+		showPeers(data);
+		break;
+	case "log":
+		writeLine("log", data);
+		trimLines("log", maxLogLines);
+		break;
+	case "stats":
+		document.getElementById("stats").textContent = data;
+		break;
+	}
+};
+
+socket.onclose = function () {
+	writeLine("log", "lost the connection to the node, reload to try again");
+	localStorage.removeItem("p2pchat-token"); // it may have been wrong
+};
+
+function send(request) {
+	socket.send(JSON.stringify(request));
+}
+
+// adds a line to a rolling pane, keeping it scrolled to the bottom if it was
+function writeLine(id, text) {
+	var pane = document.getElementById(id);
+	var atBottom = pane.scrollTop + pane.clientHeight >= pane.scrollHeight - 4;
+	var line = document.createElement("div");
+	line.textContent = text;
+	pane.appendChild(line);
+	if (atBottom) {
+		pane.scrollTop = pane.scrollHeight;
+	}
+}
+
+function trimLines(id, max) {
+	var pane = document.getElementById(id);
+	while (pane.childNodes.length > max) {
+		pane.removeChild(pane.firstChild);
+	}
+}
+
+function showRooms(names) {
+	if (names.indexOf(currentRoom) < 0) {
+		selectRoom(names.length > 0 ? names[0] : "");
+	}
+	var rooms = document.getElementById("rooms");
+	rooms.textContent = "";
+	names.forEach(function (name) {
+		var button = document.createElement("button");
+		button.textContent = name;
+		if (name === currentRoom) {
+			button.className = "current";
+		}
+		button.onclick = function () {
+			selectRoom(name);
+			showRooms(names);
+		};
+		rooms.appendChild(button);
+	});
+}
+
+function selectRoom(name) {
+	currentRoom = name;
+	document.getElementById("room-title").textContent = name;
+	document.getElementById("messages").textContent = "";
+	if (name !== "") {
+		send({type: "history", room: name});
+	}
+}
+
+// the same as a line in the terminal's peer pane
+function showPeers(peers) {
+	var lines = peers.map(function (peer) {
+		var line = peer.gid.slice(0, 12);
+		if (peer.listen_addr) {
+			line += " at " + peer.listen_addr;
+		}
+		line += " " + peer.connections + " rx " + peer.rx_packets + "/" + Math.floor(peer.rx_bytes / 1024) + "KB";
+		if (peer.throttled > 0) {
+			line += " throttled " + peer.throttled;
+		}
+		if (peer.tx_queued > 0 || peer.tx_dropped > 0) {
+			line += " tx queue " + peer.tx_queued + " dropped " + peer.tx_dropped;
+		}
+		return line;
+	});
+	lines.sort();
+	document.getElementById("peers").textContent = "";
+	lines.forEach(function (line) { writeLine("peers", line); });
+}
+
+document.getElementById("message-form").onsubmit = function (event) {
+	event.preventDefault();
+	var input = document.getElementById("message");
+	if (input.value !== "" && currentRoom !== "") {
+		send({type: "send", room: currentRoom, text: input.value});
+	}
+	input.value = "";
+};
+
+document.getElementById("connect-form").onsubmit = function (event) {
+	event.preventDefault();
+	var input = document.getElementById("connect");
+	send({type: "connect", text: input.value});
+	input.value = "";
+};
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/jasonfantl/P2PChat/Chat"
+)
+
+func startTestWeb(t *testing.T) *httptest.Server {
+	client = Chat.NewClient(t.TempDir(), func(string) {})
+	server := httptest.NewServer(webHandler(testToken))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialTestWeb(t *testing.T, server *httptest.Server, protocols []string, header http.Header) (*websocket.Conn, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, response, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/ws", &websocket.DialOptions{
+		Subprotocols: protocols,
+		HTTPHeader:   header,
+	})
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	}
+	if err != nil {
+		return nil, status
+	}
+	t.Cleanup(func() { ws.CloseNow() })
+	return ws, status
+}
+
+func TestWebSocket(t *testing.T) {
+	server := startTestWeb(t)
+	client.JoinRoom("friends", make([]byte, 16))
+
+	ws, _ := dialTestWeb(t, server, []string{webProtocol, webTokenProtocol + testToken}, nil)
+	if ws == nil {
+		t.Fatalf("could not connect with the token as a subprotocol")
+	}
+	if ws.Subprotocol() != webProtocol {
+		t.Errorf("agreed on subprotocol %q", ws.Subprotocol())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	message := webMessage{}
+	if err := wsjson.Read(ctx, ws, &message); err != nil || message.Type != "rooms" {
+		t.Fatalf("first message was %+v, %v", message, err)
+	}
+
+	// asking for history is answered over the same socket
+	if err := wsjson.Write(ctx, ws, webRequest{Type: "history", Room: "friends"}); err != nil {
+		t.Fatal(err)
+	}
+	for message.Type != "history" {
+		if err := wsjson.Read(ctx, ws, &message); err != nil {
+			t.Fatalf("no history: %v", err)
+		}
+	}
+}
+
+func TestWebSocketRefused(t *testing.T) {
+	server := startTestWeb(t)
+
+	cases := []struct {
+		name      string
+		protocols []string
+		header    http.Header
+		status    int
+	}{
+		{"no token", []string{webProtocol}, nil, http.StatusUnauthorized},
+		{"wrong token", []string{webProtocol, webTokenProtocol + "wrong"}, nil, http.StatusUnauthorized},
+		{"other origin", []string{webProtocol, webTokenProtocol + testToken}, http.Header{"Origin": {"http://evil.example"}}, http.StatusForbidden},
+		{"other port", []string{webProtocol, webTokenProtocol + testToken}, http.Header{"Origin": {"http://127.0.0.1:1"}}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		ws, status := dialTestWeb(t, server, c.protocols, c.header)
+		if ws != nil || status != c.status {
+			t.Errorf("%s: got %d, expected %d", c.name, status, c.status)
+		}
+	}
+
+	// the token in the URL doesnt count
+	response, err := http.Get(server.URL + "/ws?token=" + testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token in the URL got %d", response.StatusCode)
+	}
+
+	// the page itself needs no token
+	response, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("page got %d", response.StatusCode)
+	}
+}